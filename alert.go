@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	webhookAttempts = 5
+)
+
+type alertConfig struct {
+	// Connect overrides the server given with -connect
+	Connect  string        `yaml:"connect"`
+	Interval time.Duration `yaml:"interval"`
+	Webhooks []string      `yaml:"webhooks"`
+	Rules    []alertRule   `yaml:"rules"`
+}
+
+// alertRule fires for each tube matching Tube which meets any of its
+// conditions.
+type alertRule struct {
+	Name string `yaml:"name"`
+	Tube string `yaml:"tube"`
+
+	BuriedAbove     *int64        `yaml:"buried_above"`
+	ReadyAbove      *int64        `yaml:"ready_above"`
+	ReadyGrowingFor time.Duration `yaml:"ready_growing_for"`
+	NoWatchers      bool          `yaml:"no_watchers"`
+}
+
+type alert struct {
+	Status  string    `json:"status"`
+	Rule    string    `json:"rule"`
+	Tube    string    `json:"tube"`
+	Server  string    `json:"server"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type notification struct {
+	alert    alert
+	webhooks []string
+}
+
+// tubeHistory tracks a tube between polls.
+type tubeHistory struct {
+	ready        int64
+	growingSince time.Time
+}
+
+type alerter struct {
+	configPath string
+	config     *alertConfig
+	server     *server
+	env        env
+
+	history map[string]*tubeHistory
+	firing  map[string]alert
+	send    chan notification
+}
+
+func runAlert(e env, args []string) error {
+	flags := flag.NewFlagSet("alert", flag.ExitOnError)
+	configPath := flags.String("config", "alerts.yaml", "Alert rules to evaluate")
+	flags.Parse(args)
+
+	a := &alerter{
+		configPath: *configPath,
+		env:        e,
+		history:    map[string]*tubeHistory{},
+		firing:     map[string]alert{},
+		send:       make(chan notification, 100),
+	}
+	if err := a.reload(); err != nil {
+		return err
+	}
+
+	go a.deliver()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for {
+		a.poll()
+
+		select {
+		case <-hup:
+			if err := a.reload(); err != nil {
+				log.Printf("keeping previous rules, unable to reload: %s", err)
+			} else {
+				log.Printf("reloaded rules from %s", a.configPath)
+			}
+		case <-time.After(a.config.Interval):
+		}
+	}
+}
+
+func loadAlertConfig(configPath string) (*alertConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &alertConfig{Interval: 30 * time.Second}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse '%s': %w", configPath, err)
+	}
+
+	if cfg.Interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i+1)
+		}
+		if rule.Tube == "" {
+			cfg.Rules[i].Tube = "*"
+		} else if _, err := path.Match(rule.Tube, ""); err != nil {
+			return nil, fmt.Errorf("rule '%s' has an invalid tube glob: %w", rule.Name, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// reload reads the rules, reconnecting if the server has changed.
+func (a *alerter) reload() error {
+	cfg, err := loadAlertConfig(a.configPath)
+	if err != nil {
+		return err
+	}
+
+	if a.config == nil || cfg.Connect != a.config.Connect {
+		opts := a.env.target
+		if cfg.Connect != "" {
+			if opts, err = a.env.config.parseTarget(cfg.Connect); err != nil {
+				return err
+			}
+		}
+
+		if a.server != nil && a.server.isConnected() {
+			a.server.Disconnect()
+		}
+		a.server = a.env.newServer(append(opts, WithHeartbeat(0))...)
+	}
+
+	a.config = cfg
+	return nil
+}
+
+// poll evaluates the rules, notifying about alerts which have started firing
+// or have resolved since the last poll.
+func (a *alerter) poll() {
+	ctx, cancel := a.server.withTimeout(context.Background())
+	defer cancel()
+
+	if err := a.server.ensureConnected(ctx); err != nil {
+		log.Printf("unable to connect: %s", err)
+		return
+	}
+
+	tubeStats, tubeErrs, err := a.server.GetTubeStats(ctx)
+	if err != nil {
+		log.Printf("unable to get tube stats: %s", err)
+		return
+	}
+
+	// Tubes whose stats couldn't be fetched, other than because they've gone,
+	// keep their history and alerts until they can be
+	unknown := map[string]bool{}
+	for tube, err := range tubeErrs {
+		if !isNotFound(err) {
+			log.Printf("unable to get stats for tube %s: %s", tube, err)
+			unknown[tube] = true
+		}
+	}
+
+	now := time.Now()
+	connection, _ := a.server.ConnectionStr()
+
+	for tube, stats := range tubeStats {
+		ready, _ := strconv.ParseInt(stats["current-jobs-ready"], 10, 64)
+
+		h, ok := a.history[tube]
+		if !ok {
+			h = &tubeHistory{ready: ready}
+			a.history[tube] = h
+		} else if ready > h.ready {
+			if h.growingSince.IsZero() {
+				h.growingSince = now
+			}
+		} else {
+			h.growingSince = time.Time{}
+		}
+		h.ready = ready
+	}
+	for tube := range a.history {
+		if _, ok := tubeStats[tube]; !ok && !unknown[tube] {
+			delete(a.history, tube)
+		}
+	}
+
+	firing := map[string]alert{}
+	for key, al := range a.firing {
+		if unknown[al.Tube] {
+			firing[key] = al
+		}
+	}
+	for _, rule := range a.config.Rules {
+		for tube, stats := range tubeStats {
+			if ok, _ := path.Match(rule.Tube, tube); !ok {
+				continue
+			}
+
+			if message := rule.evaluate(stats, a.history[tube], now); message != "" {
+				firing[rule.Name+"/"+tube] = alert{
+					Status:  "firing",
+					Rule:    rule.Name,
+					Tube:    tube,
+					Server:  connection,
+					Message: message,
+					Time:    now,
+				}
+			}
+		}
+	}
+
+	for key, al := range firing {
+		if _, ok := a.firing[key]; !ok {
+			a.notify(al)
+		}
+	}
+	for key, al := range a.firing {
+		if _, ok := firing[key]; !ok {
+			al.Status = "resolved"
+			al.Time = now
+			a.notify(al)
+		}
+	}
+	a.firing = firing
+}
+
+// evaluate returns why the rule fires for a tube, or "" if it doesn't.
+func (r alertRule) evaluate(stats map[string]string, h *tubeHistory, now time.Time) string {
+	buried, _ := strconv.ParseInt(stats["current-jobs-buried"], 10, 64)
+	ready, _ := strconv.ParseInt(stats["current-jobs-ready"], 10, 64)
+	watchers, _ := strconv.ParseInt(stats["current-watching"], 10, 64)
+
+	switch {
+	case r.BuriedAbove != nil && buried > *r.BuriedAbove:
+		return fmt.Sprintf("%d buried jobs, above %d", buried, *r.BuriedAbove)
+	case r.ReadyAbove != nil && ready > *r.ReadyAbove:
+		return fmt.Sprintf("%d ready jobs, above %d", ready, *r.ReadyAbove)
+	case r.ReadyGrowingFor > 0 && !h.growingSince.IsZero() && now.Sub(h.growingSince) >= r.ReadyGrowingFor:
+		return fmt.Sprintf("ready jobs growing for %s, now %d", now.Sub(h.growingSince).Round(time.Second), ready)
+	case r.NoWatchers && watchers == 0 && ready > 0:
+		return fmt.Sprintf("no watchers with %d ready jobs", ready)
+	}
+	return ""
+}
+
+func (a *alerter) notify(al alert) {
+	log.Printf("%s: %s on %s: %s", al.Status, al.Rule, al.Tube, al.Message)
+
+	select {
+	case a.send <- notification{al, a.config.Webhooks}:
+	default:
+		log.Printf("dropping notification, too many waiting to be sent")
+	}
+}
+
+// deliver posts notifications to the webhooks, retrying with backoff.
+func (a *alerter) deliver() {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for n := range a.send {
+		body, err := json.Marshal(n.alert)
+		if err != nil {
+			log.Printf("unable to encode notification: %s", err)
+			continue
+		}
+
+		for _, webhook := range n.webhooks {
+			backoff := time.Second
+			for attempt := 1; ; attempt++ {
+				err := postWebhook(client, webhook, body)
+				if err == nil {
+					break
+				} else if attempt == webhookAttempts {
+					log.Printf("giving up notifying %s: %s", webhook, err)
+					break
+				}
+
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+	}
+}
+
+func postWebhook(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// auditLog records changes made to beanstalk servers, one line per change.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+type actorKey struct{}
+
+func newAuditLog(path string) *auditLog {
+	if path == "" {
+		return nil
+	}
+	return &auditLog{path: expandHome(path)}
+}
+
+// withActor records who is acting within ctx, e.g. the remote address of a
+// web request.
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actor(ctx context.Context) string {
+	if a, ok := ctx.Value(actorKey{}).(string); ok {
+		return a
+	}
+
+	if current, err := user.Current(); err == nil {
+		return "shell " + current.Username
+	}
+	return "shell"
+}
+
+func (a *auditLog) record(ctx context.Context, server, format string, args ...interface{}) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to write audit log: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%s\t%s\t%s\t%s\n",
+		time.Now().Format(time.RFC3339), actor(ctx), server, fmt.Sprintf(format, args...)); err != nil {
+		return fmt.Errorf("unable to write audit log: %w", err)
+	}
+	return nil
+}
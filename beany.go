@@ -3,44 +3,127 @@ package main
 import (
 	"flag"
 	"log"
-	"net"
 	"os"
-	"strconv"
+	"time"
 
 	"github.com/fatih/color"
 )
 
 const Version = "0.0.1"
 
+// env is how beany was started, shared by the shell and the other modes.
+type env struct {
+	config *config
+
+	// defaults apply to every server, such as the transport and timeout
+	defaults []serverOption
+
+	// target is the server given with -connect
+	target []serverOption
+}
+
+// modes run beany as something other than a shell, selected by the first
+// argument.
+var modes = map[string]func(e env, args []string) error{
+	"exporter":  runExporter,
+	"redrive":   runRedrive,
+	"retention": runRetention,
+	"alert":     runAlert,
+	"bench":     runBench,
+	"check":     runCheck,
+	"consume":   runConsume,
+	"web":       runWeb,
+}
+
+// newServer returns a server using the defaults and opts, which isn't yet
+// connected.
+func (e env) newServer(opts ...serverOption) *server {
+	s := &server{}
+	for _, opt := range e.defaults {
+		opt(s)
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
 func main() {
 	flagNoColor := flag.Bool("boring", false, "Disable color output")
 	flagConnect := flag.String("connect", "127.0.0.1:11300", "Server to connect to")
+	flagConfig := flag.String("config", "", "Config file to use (default ~/"+configFile+")")
+	flagTimeout := flag.Duration("timeout", 0, "Timeout for each command, 0 for none")
+	flagHeartbeat := flag.Duration("heartbeat", 10*time.Second, "How often to check the connection, 0 to disable")
+	flagTLS := flag.Bool("tls", false, "Connect using TLS")
+	flagTLSCA := flag.String("tls-ca", "", "CA file to verify the server's certificate with")
+	flagTLSCert := flag.String("tls-cert", "", "Client certificate file")
+	flagTLSKey := flag.String("tls-key", "", "Client key file")
+	flagTLSServerName := flag.String("tls-server-name", "", "Server name to verify the server's certificate against")
+	flagTLSInsecure := flag.Bool("tls-insecure", false, "Don't verify the server's certificate")
+	flagSOCKS5 := flag.String("socks5", "", "SOCKS5 proxy to connect through")
+	flagSSH := flag.String("ssh", "", "SSH host to forward the connection through, as [user@]host[:port]")
+	flagSSHKey := flag.String("ssh-key", "", "SSH key file, otherwise uses the ssh agent")
+	flagReadOnly := flag.Bool("read-only", false, "Prevent changes to servers, e.g. deleting jobs")
+	flagAuditLog := flag.String("audit-log", "", "File to record changes to servers in")
 	flag.Parse()
 
 	if *flagNoColor || len(os.Args) > 1 {
 		color.NoColor = true
 	}
 
-	host, portStr, err := net.SplitHostPort(*flagConnect)
+	cfg, err := loadConfig(*flagConfig)
 	if err != nil {
-		host = *flagConnect
+		log.Fatal(err)
 	}
 
-	opts := []serverOption{
-		WithHost(host),
+	t := transport{
+		SOCKS5: *flagSOCKS5,
+		SSH:    *flagSSH,
+		SSHKey: *flagSSHKey,
 	}
-
-	if portStr != "" {
-		port, err := strconv.ParseUint(portStr, 10, 16)
-		if err != nil {
-			log.Fatalf("unable to parse port '%s': %s", portStr, err.Error())
+	if *flagTLS || *flagTLSCA != "" || *flagTLSCert != "" || *flagTLSKey != "" ||
+		*flagTLSServerName != "" || *flagTLSInsecure {
+		t.TLS = &tlsConfig{
+			CA:         *flagTLSCA,
+			Cert:       *flagTLSCert,
+			Key:        *flagTLSKey,
+			ServerName: *flagTLSServerName,
+			Insecure:   *flagTLSInsecure,
 		}
+	}
+
+	targetOpts, err := cfg.parseTarget(*flagConnect)
+	if err != nil {
+		log.Fatalf("unable to parse server '%s': %s", *flagConnect, err.Error())
+	}
+
+	if *flagAuditLog != "" {
+		cfg.AuditLog = *flagAuditLog
+	}
 
-		opts = append(opts, WithPort(int(port)))
+	e := env{
+		config: cfg,
+		defaults: []serverOption{
+			WithDefaultTransport(t),
+			WithDefaultReadOnly(*flagReadOnly),
+			WithAuditLog(newAuditLog(cfg.AuditLog)),
+			WithTimeout(*flagTimeout),
+			WithHeartbeat(*flagHeartbeat),
+		},
+		target: targetOpts,
 	}
 
-	cli := NewCli(opts...)
 	nonCLIArgs := flag.Args()
+	if len(nonCLIArgs) != 0 {
+		if run, ok := modes[nonCLIArgs[0]]; ok {
+			if err := run(e, nonCLIArgs[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	cli := NewCli(cfg, append(e.defaults, e.target...)...)
 
 	if len(nonCLIArgs) != 0 {
 		if err := cli.shell.Process(nonCLIArgs...); err != nil {
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kr/beanstalk"
+	"github.com/olekukonko/tablewriter"
+)
+
+// Latencies are recorded in buckets growing by 5%, from a microsecond.
+const (
+	histogramBuckets = 500
+	histogramGrowth  = 1.05
+)
+
+// Workers back off after errors, so a failing server isn't hammered.
+const (
+	minBenchBackoff = 10 * time.Millisecond
+	maxBenchBackoff = time.Second
+)
+
+type histogram struct {
+	counts [histogramBuckets]int64
+	n      int64
+	errors int64
+	max    time.Duration
+}
+
+func (h *histogram) record(d time.Duration) {
+	us := float64(d) / float64(time.Microsecond)
+	bucket := 0
+	if us > 1 {
+		bucket = int(math.Log(us) / math.Log(histogramGrowth))
+	}
+	if bucket >= histogramBuckets {
+		bucket = histogramBuckets - 1
+	}
+
+	h.counts[bucket]++
+	h.n++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *histogram) merge(other *histogram) {
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+	h.n += other.n
+	h.errors += other.errors
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// percentile returns the upper bound of the bucket containing the p'th
+// percentile.
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+
+	target := int64(math.Ceil(float64(h.n) * p / 100))
+	var seen int64
+	for i, count := range h.counts {
+		seen += count
+		if seen >= target {
+			upper := time.Duration(math.Pow(histogramGrowth, float64(i+1)) * float64(time.Microsecond))
+			if upper > h.max {
+				return h.max
+			}
+			return upper
+		}
+	}
+	return h.max
+}
+
+type benchCommand struct {
+	Ops       int64   `json:"ops"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	Errors    int64   `json:"errors"`
+	P50       string  `json:"p50"`
+	P95       string  `json:"p95"`
+	P99       string  `json:"p99"`
+	Max       string  `json:"max"`
+}
+
+type benchResult struct {
+	Tube      string                  `json:"tube"`
+	Producers int                     `json:"producers"`
+	Consumers int                     `json:"consumers"`
+	Size      int                     `json:"size"`
+	Duration  string                  `json:"duration"`
+	Commands  map[string]benchCommand `json:"commands"`
+}
+
+func runBench(e env, args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	producers := flags.Int("producers", 1, "Number of connections putting jobs")
+	consumers := flags.Int("consumers", 1, "Number of connections reserving and deleting jobs")
+	sizeStr := flags.String("size", "100B", "Size of each job, e.g. 1KiB")
+	duration := flags.Duration("duration", 10*time.Second, "How long to run for")
+	tube := flags.String("tube", "bench", "Tube to put jobs on")
+	asJSON := flags.Bool("json", false, "Output results as JSON")
+	flags.Parse(args)
+
+	size, err := parseSize(*sizeStr)
+	if err != nil {
+		return err
+	}
+
+	// Workers don't record their puts and deletes, the run as a whole is
+	// recorded instead
+	control := e.newServer(append(e.target, WithHeartbeat(0))...)
+	if control.readOnly {
+		return errReadOnly
+	}
+	if err := control.ensureConnected(context.Background()); err != nil {
+		return err
+	}
+	connection, _ := control.ConnectionStr()
+
+	// Jobs left on the tube are deleted afterwards, so it has to start empty
+	// to not delete anyone else's
+	if stats, err := control.StatsTube(context.Background(), *tube); err == nil {
+		for _, state := range []string{"ready", "reserved", "delayed", "buried"} {
+			if n, _ := strconv.Atoi(stats["current-jobs-"+state]); n > 0 {
+				control.Disconnect()
+				return fmt.Errorf("tube %s already has jobs, benchmark on an empty tube", *tube)
+			}
+		}
+	} else if !isNotFound(err) {
+		return err
+	}
+
+	newWorker := func() (*server, error) {
+		s := e.newServer(append(e.target, WithHeartbeat(0), WithAuditLog(nil))...)
+		return s, s.ensureConnected(context.Background())
+	}
+
+	body := bytes.Repeat([]byte("x"), size)
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = map[string]*histogram{"put": {}, "reserve": {}, "delete": {}}
+	)
+	collect := func(command string, h *histogram) {
+		mu.Lock()
+		results[command].merge(h)
+		mu.Unlock()
+	}
+
+	start := time.Now()
+	for i := 0; i < *producers; i++ {
+		s, err := newWorker()
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Disconnect()
+
+			put := &histogram{}
+			backoff := minBenchBackoff
+			for ctx.Err() == nil {
+				opStart := time.Now()
+				if _, err := s.Put(ctx, body, *tube); err != nil {
+					if ctx.Err() == nil {
+						put.errors++
+					}
+					backoff = benchBackoff(ctx, backoff)
+					continue
+				}
+				put.record(time.Since(opStart))
+				backoff = minBenchBackoff
+			}
+			collect("put", put)
+		}()
+	}
+
+	for i := 0; i < *consumers; i++ {
+		s, err := newWorker()
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Disconnect()
+
+			reserve, del := &histogram{}, &histogram{}
+			backoff := minBenchBackoff
+			for ctx.Err() == nil {
+				opStart := time.Now()
+				id, _, err := s.Reserve(ctx, time.Second, *tube)
+				if isReserveTimeout(err) {
+					continue
+				} else if err != nil {
+					if ctx.Err() == nil {
+						reserve.errors++
+					}
+					backoff = benchBackoff(ctx, backoff)
+					continue
+				}
+				reserve.record(time.Since(opStart))
+
+				opStart = time.Now()
+				if err := s.Delete(context.Background(), id); err != nil {
+					del.errors++
+					backoff = benchBackoff(ctx, backoff)
+					continue
+				}
+				del.record(time.Since(opStart))
+				backoff = minBenchBackoff
+			}
+			collect("reserve", reserve)
+			collect("delete", del)
+		}()
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	cleanupCtx, cleanupCancel := control.withTimeout(context.Background())
+	defer cleanupCancel()
+	for _, state := range []string{"ready", "delayed", "buried"} {
+		if _, err := control.DeleteAll(cleanupCtx, state, *tube); err != nil && !isNotFound(err) {
+			fmt.Fprintf(os.Stderr, "unable to clean up %s jobs on tube %s: %s\n", state, *tube, err)
+		}
+	}
+	control.record(context.Background(), fmt.Sprintf("ran benchmark on tube %s", *tube))
+	control.Disconnect()
+
+	result := benchResult{
+		Tube:      *tube,
+		Producers: *producers,
+		Consumers: *consumers,
+		Size:      size,
+		Duration:  elapsed.Round(time.Millisecond).String(),
+		Commands:  map[string]benchCommand{},
+	}
+	for command, h := range results {
+		result.Commands[command] = benchCommand{
+			Ops:       h.n,
+			OpsPerSec: math.Round(float64(h.n)/elapsed.Seconds()*10) / 10,
+			Errors:    h.errors,
+			P50:       h.percentile(50).Round(time.Microsecond).String(),
+			P95:       h.percentile(95).Round(time.Microsecond).String(),
+			P99:       h.percentile(99).Round(time.Microsecond).String(),
+			Max:       h.max.Round(time.Microsecond).String(),
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	fmt.Printf("Benchmarked %s for %s with %d producers and %d consumers, %d byte jobs\n\n",
+		connection, result.Duration, *producers, *consumers, size)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Command", "Ops", "Ops/s", "p50", "p95", "p99", "Max", "Errors"})
+	table.SetBorder(false)
+	for _, command := range []string{"put", "reserve", "delete"} {
+		c := result.Commands[command]
+		table.Append([]string{
+			command,
+			strconv.FormatInt(c.Ops, 10),
+			strconv.FormatFloat(c.OpsPerSec, 'f', 1, 64),
+			c.P50, c.P95, c.P99, c.Max,
+			strconv.FormatInt(c.Errors, 10),
+		})
+	}
+	table.Render()
+	return nil
+}
+
+// benchBackoff waits out the backoff after an error, or until the benchmark
+// ends, and returns the next one.
+func benchBackoff(ctx context.Context, backoff time.Duration) time.Duration {
+	select {
+	case <-ctx.Done():
+	case <-time.After(backoff):
+	}
+	return min(backoff*2, maxBenchBackoff)
+}
+
+func isReserveTimeout(err error) bool {
+	var connErr beanstalk.ConnError
+	return errors.As(err, &connErr) && connErr.Err == beanstalk.ErrTimeout
+}
+
+// parseSize parses a size in bytes, with an optional unit such as KB or KiB.
+func parseSize(s string) (int, error) {
+	units := []struct {
+		suffix     string
+		multiplier int
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20},
+		{"KB", 1000}, {"MB", 1000 * 1000},
+		{"K", 1 << 10}, {"M", 1 << 20},
+		{"B", 1},
+	}
+
+	number, multiplier := s, 1
+	for _, unit := range units {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(unit.suffix)) {
+			number = s[:len(s)-len(unit.suffix)]
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(number))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("unable to parse size '%s'", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+)
+
+// maxBodySize is how much of a rendered body is shown by default, in bytes.
+const maxBodySize = 64 * 1024
+
+// bodyOptions control how commands which show a job's body render it.
+type bodyOptions struct {
+	// as names the decoders to use, otherwise they're configured per tube or
+	// detected
+	as []string
+
+	// full shows the whole body, however long
+	full bool
+
+	// unredacted shows the body without redacting it, if the profile allows
+	unredacted bool
+}
+
+// parseBodyFlags parses the options for showing bodies from args, which may
+// come before or after the command's other arguments, returning those.
+func parseBodyFlags(name string, args []string) (bodyOptions, []string, error) {
+	var (
+		opts   bodyOptions
+		output bytes.Buffer
+	)
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(&output)
+	as := flags.String("as", "", "Decoders to use for the body, e.g. json or gzip,msgpack, from "+strings.Join(sortedMapKeys(decoders), ","))
+	flags.BoolVar(&opts.full, "full", false, "Show the whole body, however long")
+	flags.BoolVar(&opts.unredacted, "unredacted", false, "Show the body without redacting it, if allowed")
+
+	rest, err := parseFlags(flags, &output, args)
+	if err != nil {
+		return opts, nil, err
+	}
+
+	opts.as = splitDecoders(*as)
+	return opts, rest, nil
+}
+
+// parseFlags parses the flags from args, which may come before or after the
+// command's other arguments, returning those. Errors are written to output.
+func parseFlags(flags *flag.FlagSet, output *bytes.Buffer, args []string) ([]string, error) {
+	var rest []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, errors.New(strings.TrimSpace(output.String()))
+		}
+		if flags.NArg() == 0 {
+			return rest, nil
+		}
+		rest = append(rest, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// renderJob renders the job with its body decoded and redacted, for the tube
+// it's on if known.
+func (c *cli) renderJob(ctx context.Context, id uint64, tube string, body []byte, opts bodyOptions) (string, error) {
+	rendered, used, err := c.renderBody(ctx, id, tube, body, opts)
+	if err != nil {
+		return "", err
+	}
+	rendered = strings.TrimSuffix(rendered, "\n")
+
+	if limit := c.config.MaxBodySize; !opts.full && limit > 0 {
+		var more int
+		if rendered, more = truncateRendered(rendered, limit); more > 0 {
+			rendered += "\n" + color.YellowString("(%d more bytes, use --full)", more)
+		}
+	}
+
+	cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+	header := fmt.Sprintf("%s (%d bytes, %s)", cyan(fmt.Sprintf("Job #%d", id)), len(body), strings.Join(used, ", "))
+	return fmt.Sprintf("%s\n%s\n", header, rendered), nil
+}
+
+// renderBody renders the job's body decoded and redacted, for the tube it's on
+// if known, returning how it was decoded.
+func (c *cli) renderBody(ctx context.Context, id uint64, tube string, body []byte, opts bodyOptions) (string, []string, error) {
+	if tube == "" {
+		tube = c.jobTube(ctx, id)
+	}
+
+	r, err := c.redaction(ctx, tube, opts.unredacted, fmt.Sprintf("viewed job #%d", id))
+	if err != nil {
+		return "", nil, err
+	}
+
+	md, err := c.config.protobufFor(tube)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(opts.as) > 0 {
+		// Protobuf bodies can only be redacted once decoded
+		if md != nil && r != nil {
+			if body, err = protobufJSON(md, body); err != nil {
+				return "", nil, err
+			}
+		}
+		return decodeBody(body, opts.as, r)
+	}
+
+	if md != nil {
+		rendered, err := renderProtobuf(md, body, r)
+		return rendered, []string{fmt.Sprintf("protobuf %s", md.FullName())}, err
+	}
+	return decodeBody(body, c.config.decodersFor(tube), r)
+}
+
+// truncateRendered cuts a rendered body after limit bytes, not counting any
+// colours, returning how many bytes were cut.
+func truncateRendered(s string, limit int) (string, int) {
+	var shown int
+	for n := 0; n < len(s); {
+		if s[n] == '\x1b' {
+			n += colourCodeLen(s[n:])
+			continue
+		}
+
+		_, size := utf8.DecodeRuneInString(s[n:])
+		if shown+size > limit {
+			cut := s[:n]
+			if !color.NoColor {
+				cut += "\x1b[0m"
+			}
+			return cut, visibleLen(s[n:])
+		}
+		shown += size
+		n += size
+	}
+	return s, 0
+}
+
+// visibleLen is the length of s in bytes, not counting any colours.
+func visibleLen(s string) int {
+	var length int
+	for n := 0; n < len(s); {
+		if s[n] == '\x1b' {
+			n += colourCodeLen(s[n:])
+			continue
+		}
+		length++
+		n++
+	}
+	return length
+}
+
+// colourCodeLen is the length of the colour code at the start of s. Bodies
+// are escaped, so any escape character starts one.
+func colourCodeLen(s string) int {
+	if end := strings.IndexByte(s, 'm'); end >= 0 {
+		return end + 1
+	}
+	return len(s)
+}
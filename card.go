@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abiosoft/ishell"
+	"github.com/fatih/color"
+)
+
+// previewSize is how much of a job's body is shown on its card, in bytes.
+const previewSize = 72
+
+// stateColours are the colours job states are shown in.
+var stateColours = map[string]func(format string, a ...interface{}) string{
+	"ready":    color.GreenString,
+	"reserved": color.BlueString,
+	"delayed":  color.YellowString,
+	"buried":   color.RedString,
+}
+
+// jobCard renders the job's stats, with a preview of its body.
+func (c *cli) jobCard(ctx context.Context, id uint64) (string, error) {
+	stats, err := c.server.StatsJob(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	seconds := func(stat string) time.Duration {
+		n, _ := strconv.Atoi(stats[stat])
+		return time.Duration(n) * time.Second
+	}
+
+	var sb strings.Builder
+	cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+	line := func(label, format string, a ...interface{}) {
+		sb.WriteString(fmt.Sprintf("%s %s\n", cyan(fmt.Sprintf("%-9s", label)), fmt.Sprintf(format, a...)))
+	}
+
+	state := stats["state"]
+	colour, ok := stateColours[state]
+	if !ok {
+		colour = fmt.Sprintf
+	}
+	sb.WriteString(fmt.Sprintf("%s  %s\n", cyan(fmt.Sprintf("Job #%d", id)), colour("%s", state)))
+
+	line("Tube", "%s", stats["tube"])
+	if pri, _ := strconv.Atoi(stats["pri"]); pri < 1024 {
+		line("Priority", "%s (urgent)", stats["pri"])
+	} else {
+		line("Priority", "%s", stats["pri"])
+	}
+
+	age := seconds("age")
+	line("Created", "%s (%s ago)", time.Now().Add(-age).Format("2006-01-02 15:04:05"), age)
+
+	switch state {
+	case "delayed":
+		line("Delay", "%s, %s left", seconds("delay"), seconds("time-left"))
+	case "reserved":
+		line("TTR", "%s, %s left", seconds("ttr"), seconds("time-left"))
+	default:
+		line("TTR", "%s", seconds("ttr"))
+	}
+
+	line("History", "%s reserves, %s timeouts, %s releases, %s buries, %s kicks",
+		stats["reserves"], stats["timeouts"], stats["releases"], stats["buries"], stats["kicks"])
+
+	if body, err := c.server.PeekJob(ctx, id); err != nil {
+		line("Body", "%s", color.RedString("%s", err))
+	} else if preview, _, err := c.renderBody(ctx, id, stats["tube"], body, bodyOptions{}); err != nil {
+		line("Body", "%s", color.RedString("%s", err))
+	} else {
+		preview, more := truncateRendered(strings.Join(strings.Fields(preview), " "), previewSize)
+		if more > 0 {
+			preview += "…"
+		}
+		line("Body", "%s (%d bytes)", preview, len(body))
+	}
+
+	return sb.String(), nil
+}
+
+// watch shows what render returns every interval, clearing the screen each
+// time, until interrupted or render fails.
+func (c *cli) watch(i *ishell.Context, interval time.Duration, render func(ctx context.Context) (string, error)) {
+	ctx, cancel := c.interruptible()
+	defer cancel()
+
+	for {
+		renderCtx, renderCancel := c.server.withTimeout(ctx)
+		s, err := render(renderCtx)
+		renderCancel()
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			outputError(err, i)
+			return
+		}
+
+		i.Print("\x1b[H\x1b[2J" + s)
+		i.Println(color.New(color.Faint).Sprintf("\nEvery %s, Ctrl-C to stop", interval))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
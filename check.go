@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Nagios plugin exit codes
+const (
+	checkOK = iota
+	checkWarning
+	checkCritical
+	checkUnknown
+)
+
+var checkStatus = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// threshold is a limit on a tube stat, unset when negative.
+type threshold struct {
+	warn, crit int64
+	// below is set for minimums, where falling below the limit is a problem
+	below bool
+}
+
+func (t threshold) status(value int64) int {
+	exceeds := func(limit int64) bool {
+		if limit < 0 {
+			return false
+		}
+		if t.below {
+			return value < limit
+		}
+		return value > limit
+	}
+
+	if exceeds(t.crit) {
+		return checkCritical
+	} else if exceeds(t.warn) {
+		return checkWarning
+	}
+	return checkOK
+}
+
+func (t threshold) perfdata(label string, value int64, unit string) string {
+	limit := func(l int64) string {
+		if l < 0 {
+			return ""
+		}
+		if t.below {
+			return strconv.FormatInt(l, 10) + ":"
+		}
+		return strconv.FormatInt(l, 10)
+	}
+	return fmt.Sprintf("'%s'=%d%s;%s;%s;0;", label, value, unit, limit(t.warn), limit(t.crit))
+}
+
+func runCheck(e env, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	tubeGlob := flags.String("tube", "*", "Tubes to check, may be a glob")
+	maxBuried := flags.Int64("max-buried", -1, "Critical above this many buried jobs")
+	warnBuried := flags.Int64("warn-buried", -1, "Warning above this many buried jobs")
+	maxReady := flags.Int64("max-ready", -1, "Critical above this many ready jobs")
+	warnReady := flags.Int64("warn-ready", -1, "Warning above this many ready jobs")
+	maxOldestReady := flags.Duration("max-oldest-ready", -1, "Critical if the next ready job is older than this")
+	warnOldestReady := flags.Duration("warn-oldest-ready", -1, "Warning if the next ready job is older than this")
+	minWatchers := flags.Int64("min-watchers", -1, "Critical below this many watchers, for tubes with ready jobs")
+	warnWatchers := flags.Int64("warn-watchers", -1, "Warning below this many watchers, for tubes with ready jobs")
+	timeout := flags.Duration("timeout", 10*time.Second, "Give up as UNKNOWN after this long, 0 for never")
+	if err := flags.Parse(args); err != nil {
+		exitCheck(checkUnknown, err.Error(), nil)
+	}
+
+	if _, err := path.Match(*tubeGlob, ""); err != nil {
+		exitCheck(checkUnknown, fmt.Sprintf("invalid tube glob '%s': %s", *tubeGlob, err), nil)
+	}
+
+	seconds := func(d time.Duration) int64 {
+		if d < 0 {
+			return -1
+		}
+		return int64(d / time.Second)
+	}
+
+	c := tubeCheck{
+		glob:        *tubeGlob,
+		buried:      threshold{warn: *warnBuried, crit: *maxBuried},
+		ready:       threshold{warn: *warnReady, crit: *maxReady},
+		oldestReady: threshold{warn: seconds(*warnOldestReady), crit: seconds(*maxOldestReady)},
+		watchers:    threshold{warn: *warnWatchers, crit: *minWatchers, below: true},
+	}
+
+	// A hung server mustn't hang the check, so it's bounded as a whole
+	checkCtx, checkCancel := context.WithCancel(context.Background())
+	if *timeout > 0 {
+		checkCtx, checkCancel = context.WithTimeout(context.Background(), *timeout)
+	}
+	defer checkCancel()
+
+	s := e.newServer(append(e.target, WithHeartbeat(0))...)
+	ctx, cancel := s.withTimeout(checkCtx)
+	defer cancel()
+
+	status, problems, perfdata, err := c.run(ctx, s)
+	if checkCtx.Err() != nil {
+		exitCheck(checkUnknown, fmt.Sprintf("timed out after %s", *timeout), nil)
+	} else if err != nil {
+		exitCheck(checkUnknown, err.Error(), nil)
+	}
+
+	summary := strings.Join(problems, ", ")
+	if summary == "" {
+		summary = "all tubes within thresholds"
+	}
+	exitCheck(status, summary, perfdata)
+	return nil
+}
+
+type tubeCheck struct {
+	glob                                 string
+	buried, ready, oldestReady, watchers threshold
+}
+
+func (c tubeCheck) run(ctx context.Context, s *server) (int, []string, []string, error) {
+	if err := s.ensureConnected(ctx); err != nil {
+		return checkUnknown, nil, nil, err
+	}
+	defer s.Disconnect()
+
+	status := checkOK
+	var problems, perfdata []string
+
+	report := func(st int, problem string) {
+		if st > status {
+			status = st
+		}
+		if st != checkOK {
+			problems = append(problems, problem)
+		}
+	}
+
+	stats, err := s.Stats(ctx)
+	if err != nil {
+		return checkUnknown, nil, nil, err
+	}
+	if stats["draining"] == "true" {
+		report(checkWarning, "server is draining")
+	}
+
+	tubes, err := s.ListTubes(ctx)
+	if err != nil {
+		return checkUnknown, nil, nil, err
+	}
+
+	var matched int
+	for _, tube := range tubes {
+		if ok, _ := path.Match(c.glob, tube); !ok {
+			continue
+		}
+		matched++
+
+		stats, err := s.StatsTube(ctx, tube)
+		if err != nil {
+			return checkUnknown, nil, nil, fmt.Errorf("unable to stats tube '%s': %w", tube, err)
+		}
+
+		buried, _ := strconv.ParseInt(stats["current-jobs-buried"], 10, 64)
+		ready, _ := strconv.ParseInt(stats["current-jobs-ready"], 10, 64)
+		watchers, _ := strconv.ParseInt(stats["current-watching"], 10, 64)
+
+		report(c.buried.status(buried), fmt.Sprintf("%s: %d buried", tube, buried))
+		report(c.ready.status(ready), fmt.Sprintf("%s: %d ready", tube, ready))
+		perfdata = append(perfdata,
+			c.buried.perfdata(tube+"_buried", buried, ""),
+			c.ready.perfdata(tube+"_ready", ready, ""))
+
+		if ready > 0 {
+			report(c.watchers.status(watchers), fmt.Sprintf("%s: %d watchers", tube, watchers))
+		}
+		perfdata = append(perfdata, c.watchers.perfdata(tube+"_watchers", watchers, ""))
+
+		if c.oldestReady.warn >= 0 || c.oldestReady.crit >= 0 {
+			age, err := oldestReadyAge(ctx, s, tube)
+			if err != nil {
+				return checkUnknown, nil, nil, fmt.Errorf("unable to find oldest ready job on '%s': %w", tube, err)
+			}
+
+			report(c.oldestReady.status(age), fmt.Sprintf("%s: next ready job is %s old", tube, time.Duration(age)*time.Second))
+			perfdata = append(perfdata, c.oldestReady.perfdata(tube+"_oldest_ready", age, "s"))
+		}
+	}
+
+	if matched == 0 {
+		return checkUnknown, nil, nil, fmt.Errorf("no tubes match '%s'", c.glob)
+	}
+
+	return status, problems, perfdata, nil
+}
+
+// oldestReadyAge returns the age in seconds of the job at the front of the
+// ready queue, or 0 if there isn't one. beanstalkd orders the queue by
+// priority, so this is the oldest job of the most urgent priority.
+func oldestReadyAge(ctx context.Context, s *server, tube string) (int64, error) {
+	id, _, err := s.Peek(ctx, "ready", tube)
+	if isNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	stats, err := s.StatsJob(ctx, id)
+	if isNotFound(err) {
+		// Reserved or deleted since peeking
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	age, err := strconv.ParseInt(stats["age"], 10, 64)
+	if err != nil {
+		return 0, errors.New("unable to parse job age")
+	}
+	return age, nil
+}
+
+// exitCheck prints the check result in the format expected by Nagios and
+// exits with its status.
+func exitCheck(status int, summary string, perfdata []string) {
+	line := fmt.Sprintf("BEANSTALK %s - %s", checkStatus[status], summary)
+	if len(perfdata) > 0 {
+		line += " | " + strings.Join(perfdata, " ")
+	}
+	fmt.Println(line)
+	os.Exit(status)
+}
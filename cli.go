@@ -2,21 +2,30 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/abiosoft/ishell"
 	"github.com/fatih/color"
 	"github.com/nsf/termbox-go"
-	"github.com/olekukonko/tablewriter"
 )
 
 const (
@@ -24,11 +33,23 @@ const (
 )
 
 type cli struct {
+	config *config
 	server *server
 	shell  *ishell.Shell
+
+	cancelMu sync.Mutex
+	cancel   context.CancelFunc
+
+	// tubes caches the tube names for completion
+	tubesMu  sync.Mutex
+	tubes    []string
+	tubesAge time.Time
 }
 
-func NewCli(serverOpts ...serverOption) *cli {
+// tubesCacheTTL is how long the tube names are cached for completion
+const tubesCacheTTL = 5 * time.Second
+
+func NewCli(cfg *config, serverOpts ...serverOption) *cli {
 	shell := ishell.New()
 
 	if pager := os.Getenv("PAGER"); pager != "" {
@@ -46,22 +67,34 @@ func NewCli(serverOpts ...serverOption) *cli {
 		serverOpt(server)
 	}
 
-	server.connect()
+	server.connect(context.Background())
 
-	cli := cli{server, shell}
+	cli := cli{config: cfg, server: server, shell: shell}
+	cli.handleInterrupts()
+	server.onChange = cli.setPrompt
 
 	cli.addConnectCmd()
 	cli.addDeleteCmd()
 	cli.addDisconnectCmd()
 	cli.addInfoCmd()
 	cli.addKickCmd()
+	cli.addKickJobCmd()
 	cli.addListTubesCmd()
+	cli.addMaintenanceCmd()
+	cli.addOpenCmd()
+	cli.addPauseCmd()
 	cli.addPeekJobCmd()
 	cli.addPutCmd()
+	cli.addSaveCmd()
+	cli.addSaveStateCmd()
+	cli.addSetCmd()
 	cli.addStatsCmd()
 	cli.addStatsJobCmd()
 	cli.addStatsTubeCmd()
+	cli.addTrackCmd()
+	cli.addUnpauseCmd()
 	cli.addUseTubeCmd()
+	cli.addValidateCmd()
 	cli.addVersionCmd()
 
 	for _, state := range []string{"buried", "delayed", "ready"} {
@@ -84,31 +117,39 @@ func (c *cli) addConnectCmd() {
 		Name:     "connect",
 		Help:     "connects to a beanstalk server",
 		LongHelp: helpConnect,
+		Completer: func(args []string) []string {
+			var profiles []string
+			for _, name := range sortedMapKeys(c.config.Profiles) {
+				profiles = append(profiles, "@"+name)
+			}
+			return profiles
+		},
 		Func: func(i *ishell.Context) {
-			var host string
-			var port int
+			var opts []serverOption
+			var err error
 
 			if len(i.Args) == 0 {
-				host = "127.0.0.1"
-				port = 11300
+				opts, err = c.config.parseTarget("127.0.0.1:11300")
 			} else if len(i.Args) == 1 {
-				host = i.Args[0]
+				opts, err = c.config.parseTarget(i.Args[0])
 			} else if len(i.Args) == 2 {
-				host = i.Args[0]
-				var err error
-				if port, err = strconv.Atoi(i.Args[1]); err != nil {
-					outputError(err, i)
-					return
-				}
+				opts, err = parseHostPort(i.Args[0], i.Args[1])
 			} else {
-				outputError(errors.New("too many arguments"), i)
+				err = errors.New("too many arguments")
+			}
+			if err != nil {
+				outputError(err, i)
 				return
 			}
 
-			if err := c.server.Connect(host, port); err != nil {
+			ctx, cancel := c.context()
+			defer cancel()
+
+			if err := c.server.Connect(ctx, opts...); err != nil {
 				outputError(err, i)
 				return
 			}
+			c.forgetTubes()
 
 			outputConnectionInfo(c, i)
 			c.setPrompt()
@@ -120,37 +161,113 @@ func (c *cli) addDeleteCmd() {
 	c.shell.AddCmd(&ishell.Cmd{
 		Name:     "delete",
 		Aliases:  []string{"del", "dj"},
-		Help:     "delete a job",
+		Help:     "delete jobs",
 		LongHelp: helpDelete,
 		Func: func(i *ishell.Context) {
-			var toDeleteStr string
-			if len(i.Args) == 1 {
-				toDeleteStr = i.Args[0]
-			} else {
-				outputError(errors.New("wrong number of arguments provided"), i)
-				return
-			}
-
-			toDelete, err := strconv.ParseUint(toDeleteStr, 10, 64)
+			toDelete, err := getJobsFromArgs(i)
 			if err != nil {
 				outputError(err, i)
 				return
 			}
 
-			msg := fmt.Sprintf("Are you sure you want to delete job #%v", toDelete)
-			if !c.getConfirmation(msg, i) {
-				return
-			}
-
-			if err := c.server.Delete(toDelete); err != nil {
-				outputError(err, i)
+			toDelete = uniqueJobs(toDelete)
+			if len(toDelete) == 1 {
+				c.deleteJob(toDelete[0], i)
 			} else {
-				outputInfo(fmt.Sprintf("Deleted job #%v", toDelete), i)
+				c.deleteJobs(toDelete, i)
 			}
 		},
 	})
 }
 
+func (c *cli) deleteJob(toDelete uint64, i *ishell.Context) {
+	msg := fmt.Sprintf("Are you sure you want to delete job #%v", toDelete)
+	if !c.getConfirmation(msg, i) {
+		return
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	if err := c.server.Delete(ctx, toDelete); err != nil {
+		outputError(err, i)
+	} else {
+		outputInfo(fmt.Sprintf("Deleted job #%v", toDelete), i)
+	}
+}
+
+// deleteJobs deletes the jobs in parallel, after confirming the number of
+// jobs and the tubes they're on.
+func (c *cli) deleteJobs(toDelete []uint64, i *ishell.Context) {
+	if c.server.readOnly {
+		outputError(errReadOnly, i)
+		return
+	}
+
+	ctx, cancel := c.context()
+	tubes := make([]string, len(toDelete))
+	errs := c.server.parallel(ctx, len(toDelete), func(conn *server, n int) error {
+		stats, err := conn.StatsJob(ctx, toDelete[n])
+		tubes[n] = stats["tube"]
+		return err
+	})
+	cancel()
+
+	var (
+		found     []uint64
+		notFound  int
+		tubeCount = map[string]int{}
+	)
+	for n, err := range errs {
+		if isNotFound(err) {
+			notFound++
+		} else if err != nil {
+			outputError(err, i)
+			return
+		} else {
+			found = append(found, toDelete[n])
+			tubeCount[tubes[n]]++
+		}
+	}
+
+	if len(found) == 0 {
+		outputError(fmt.Errorf("None of the %d jobs were found", len(toDelete)), i)
+		return
+	}
+
+	var onTubes []string
+	for _, tube := range sortedMapKeys(tubeCount) {
+		onTubes = append(onTubes, fmt.Sprintf("%s (%d)", tube, tubeCount[tube]))
+	}
+	if notFound > 0 {
+		outputInfo(fmt.Sprintf("%d of the %d jobs weren't found", notFound, len(toDelete)), i)
+	}
+	msg := fmt.Sprintf("Are you sure you want to delete %d jobs from %s", len(found), strings.Join(onTubes, ", "))
+	if !c.getConfirmation(msg, i) {
+		return
+	}
+
+	ctx, cancel = c.context()
+	defer cancel()
+
+	var deleted, failed int
+	errs = c.server.parallel(ctx, len(found), func(conn *server, n int) error {
+		return conn.Delete(ctx, found[n])
+	})
+	for n, err := range errs {
+		if err == nil {
+			deleted++
+		} else if isNotFound(err) {
+			notFound++
+		} else {
+			failed++
+			outputError(fmt.Errorf("Job #%d: %w", found[n], err), i)
+		}
+	}
+
+	outputInfo(fmt.Sprintf("Deleted %d jobs, %d not found, %d failed", deleted, notFound, failed), i)
+}
+
 func (c *cli) addDeleteAllCmd(state string) {
 	c.shell.AddCmd(&ishell.Cmd{
 		Name:      fmt.Sprintf("delete-%s", state),
@@ -171,11 +288,18 @@ func (c *cli) addDeleteAllCmd(state string) {
 				return
 			}
 
-			if n, _ := c.server.DeleteAll(state, tube); n > 0 {
+			ctx, cancel := c.context()
+			defer cancel()
+
+			n, err := c.server.DeleteAll(ctx, state, tube)
+			if n > 0 {
 				outputInfo(fmt.Sprintf("Deleted %d %s jobs", n, state), i)
 			} else if n == 0 {
 				outputError(fmt.Errorf("No %s jobs deleted", state), i)
 			}
+			if err != nil && !isNotFound(err) {
+				outputError(err, i)
+			}
 		},
 	})
 }
@@ -189,6 +313,7 @@ func (c *cli) addDisconnectCmd() {
 			if err := c.server.Disconnect(); err != nil {
 				outputError(err, i)
 			}
+			c.forgetTubes()
 			c.setPrompt()
 		},
 	})
@@ -217,9 +342,12 @@ func (c *cli) addKickCmd() {
 				return
 			}
 
+			ctx, cancel := c.context()
+			defer cancel()
+
 			var toKickStr string
 			if len(i.Args) == 0 {
-				if stats, err := c.server.StatsTube(tube); err != nil {
+				if stats, err := c.server.StatsTube(ctx, tube); err != nil {
 					outputError(err, i)
 					return
 				} else {
@@ -238,7 +366,7 @@ func (c *cli) addKickCmd() {
 				return
 			}
 
-			if kicked, err := c.server.Kick(tube, toKick); err != nil {
+			if kicked, err := c.server.Kick(ctx, tube, toKick); err != nil {
 				outputError(err, i)
 			} else {
 				outputInfo(fmt.Sprintf("Kicked %v jobs", kicked), i)
@@ -247,264 +375,952 @@ func (c *cli) addKickCmd() {
 	})
 }
 
-func (c *cli) addListTubesCmd() {
+func (c *cli) addKickJobCmd() {
 	c.shell.AddCmd(&ishell.Cmd{
-		Name:     "list-tubes",
-		Aliases:  []string{"lt", "list"},
-		Help:     "lists tubes",
-		LongHelp: helpListTubes,
+		Name:     "kick-job",
+		Aliases:  []string{"kj"},
+		Help:     "kick jobs by id",
+		LongHelp: helpKickJob,
 		Func: func(i *ishell.Context) {
-			tubes, err := c.server.GetTubeStats()
+			ids, err := getJobsFromArgs(i)
 			if err != nil {
 				outputError(err, i)
 				return
 			}
 
-			var output bytes.Buffer
-			table := tablewriter.NewWriter(&output)
-			table.SetHeader([]string{"Tube", "Ready", "Delayed", "Buried"})
-			table.SetBorder(false)
-			cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+			ctx, cancel := c.context()
+			defer cancel()
+
+			var (
+				output bytes.Buffer
+				kicked int
+			)
+			boldCyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+			boldRed := color.New(color.FgRed, color.Bold).SprintFunc()
+
+			for _, id := range ids {
+				err := c.server.KickJob(ctx, id)
+				if err == nil {
+					kicked++
+					fmt.Fprintln(&output, boldCyan(fmt.Sprintf("Kicked job #%d", id)))
+					continue
+				}
 
-			for _, tube := range sortedMapKeys(tubes) {
-				stats := tubes[tube]
-				table.Append([]string{
-					cyan(tube),
-					color.GreenString(stats["current-jobs-ready"]),
-					color.YellowString(stats["current-jobs-delayed"]),
-					color.RedString(stats["current-jobs-buried"]),
-				})
+				if ctx.Err() != nil || !isNotFound(err) {
+					fmt.Fprintln(&output, boldRed(fmt.Sprintf("Job #%d: %s", id, err)))
+					if ctx.Err() != nil {
+						break
+					}
+					continue
+				}
+
+				// kick-job doesn't say whether the job is missing or in
+				// the wrong state
+				if stats, err := c.server.StatsJob(ctx, id); err == nil {
+					fmt.Fprintln(&output, boldRed(fmt.Sprintf("Job #%d: not buried or delayed, it's %s", id, stats["state"])))
+				} else {
+					fmt.Fprintln(&output, boldRed(fmt.Sprintf("Job #%d: not found", id)))
+				}
 			}
 
-			table.Render()
+			fmt.Fprintln(&output, boldCyan(fmt.Sprintf("Kicked %d of %d jobs", kicked, len(ids))))
 			outputPaged(output.String(), i)
 		},
 	})
 }
 
-func (c *cli) addPeekJobCmd() {
+func (c *cli) addListTubesCmd() {
 	c.shell.AddCmd(&ishell.Cmd{
-		Name:      "peek",
-		Aliases:   []string{"p"},
-		Help:      "peek at the given job",
-		LongHelp:  helpPeekJob,
-		Completer: func(args []string) []string { return []string{} },
+		Name:     "list-tubes",
+		Aliases:  []string{"lt", "list"},
+		Help:     "lists tubes",
+		LongHelp: helpListTubes,
 		Func: func(i *ishell.Context) {
-			job, err := getJobFromArgs(c, i)
+			ctx, cancel := c.context()
+			defer cancel()
+
+			opts, err := c.listTubesOptions(i.Args)
 			if err != nil {
 				outputError(err, i)
 				return
 			}
 
-			if jobDetails, err := c.server.PeekJob(job); err != nil {
+			tubes, tubeErrs, err := c.server.GetTubeStats(ctx)
+			if err != nil {
 				outputError(err, i)
-			} else {
-				cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
-				details := fmt.Sprintf("%s\n%s",
-					cyan(fmt.Sprintf("Job #%d\n", job)),
-					jobDetails,
-				)
-				outputPaged(details, i)
+				return
+			}
+
+			output := renderTubes(tubes, opts)
+			boldRed := color.New(color.FgRed, color.Bold).SprintFunc()
+			for _, tube := range sortedMapKeys(tubeErrs) {
+				if ok, _ := path.Match(opts.Filter, tube); opts.Filter != "" && !ok {
+					continue
+				}
+				if isNotFound(tubeErrs[tube]) {
+					output += boldRed(fmt.Sprintf("Tube %s has gone since being listed", tube)) + "\n"
+				} else {
+					output += boldRed(fmt.Sprintf("Unable to get stats for tube %s: %s", tube, tubeErrs[tube])) + "\n"
+				}
 			}
+			outputPaged(output, i)
 		},
 	})
 }
 
-func (c *cli) addPeekCmd(state string) {
+func (c *cli) addMaintenanceCmd() {
 	c.shell.AddCmd(&ishell.Cmd{
-		Name:      fmt.Sprintf("peek-%s", state),
-		Aliases:   []string{fmt.Sprintf("p%c", state[0])},
-		Help:      fmt.Sprintf("peek at %s jobs", state),
-		LongHelp:  fmt.Sprintf(helpPeek, state, state, state[0]),
-		Completer: c.listTubes,
+		Name:     "maintenance",
+		Help:     "pause every tube for maintenance",
+		LongHelp: helpMaintenance,
+		Completer: func([]string) []string {
+			return []string{"on", "off"}
+		},
 		Func: func(i *ishell.Context) {
-			tube, err := getTubeFromArgs(c, i)
-			if err != nil {
-				outputError(err, i)
+			if len(i.Args) != 1 {
+				outputError(errors.New("wrong number of arguments provided"), i)
 				return
 			}
 
-			if id, body, err := c.server.Peek(state, tube); err != nil {
-				outputError(err, i)
-			} else {
-				cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
-				details := fmt.Sprintf("%s\n%s",
-					cyan(fmt.Sprintf("Job #%v", id)),
-					string(body))
-				outputPaged(details, i)
+			ctx, cancel := c.context()
+			defer cancel()
+
+			switch i.Args[0] {
+			case "on":
+				if n, err := startMaintenance(ctx, c.server, c.config.MaintenanceFile); err != nil {
+					outputError(err, i)
+				} else {
+					outputInfo(fmt.Sprintf("Paused %d tubes for maintenance", n), i)
+				}
+			case "off":
+				if n, err := endMaintenance(ctx, c.server, c.config.MaintenanceFile); err != nil {
+					outputError(err, i)
+				} else {
+					outputInfo(fmt.Sprintf("Restored %d tubes after maintenance", n), i)
+				}
+			default:
+				outputError(fmt.Errorf("expected 'on' or 'off', not '%s'", i.Args[0]), i)
 			}
 		},
 	})
 }
 
-func (c *cli) addPutCmd() {
+func (c *cli) addOpenCmd() {
 	c.shell.AddCmd(&ishell.Cmd{
-		Name:      "put",
-		Help:      "puts data on the current tube",
-		LongHelp:  helpPut,
-		Completer: c.listTubes,
+		Name:      "open",
+		Help:      "open a job's body in a viewer",
+		LongHelp:  helpOpen,
+		Completer: func(args []string) []string { return []string{} },
 		Func: func(i *ishell.Context) {
-			tube, err := getTubeFromArgs(c, i)
+			var output bytes.Buffer
+			flags := flag.NewFlagSet("open", flag.ContinueOnError)
+			flags.SetOutput(&output)
+			unredacted := flags.Bool("unredacted", false, "Open the body without redacting it, if allowed")
+
+			args, err := parseFlags(flags, &output, i.Args)
 			if err != nil {
 				outputError(err, i)
 				return
 			}
+			i.Args = args
 
-			temp, err := ioutil.TempFile(os.TempDir(), "beany")
+			job, err := getJobFromArgs(c, i)
 			if err != nil {
 				outputError(err, i)
 				return
 			}
-			defer os.Remove(temp.Name())
-
-			var cmd *exec.Cmd
-
-			if editor := os.Getenv("EDITOR"); editor != "" {
-				editorArgs := strings.Split(editor, " ")
-				editorArgs = append(editorArgs, temp.Name())
-				cmd = exec.Command(editorArgs[0], editorArgs[1:]...)
-			} else {
-				cmd = exec.Command("vi", temp.Name())
-			}
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
 
-			if err := cmd.Start(); err != nil {
-				outputError(err, i)
-				return
+			ctx, cancel := c.context()
+			body, err := c.server.PeekJob(ctx, job)
+			if err == nil {
+				body, err = c.exportBody(ctx, job, body, *unredacted)
 			}
-			if err := cmd.Wait(); err != nil {
+			cancel()
+			if err != nil {
 				outputError(err, i)
 				return
 			}
 
-			job, err := ioutil.ReadFile(temp.Name())
+			kind := contentType(body)
+			temp, err := os.CreateTemp(os.TempDir(), fmt.Sprintf("beany-%d-*%s", job, bodyExtensions[kind]))
 			if err != nil {
 				outputError(err, i)
 				return
 			}
+			defer os.Remove(temp.Name())
 
-			if len(job) == 0 {
-				outputError(errors.New("no data in job, not adding to tube"), i)
+			_, err = temp.Write(body)
+			if closeErr := temp.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				outputError(err, i)
 				return
 			}
 
-			if id, err := c.server.Put(job, tube); err != nil {
+			if err := launch(c.viewer(kind), temp.Name()); err != nil {
 				outputError(err, i)
-			} else {
-				outputInfo(fmt.Sprintf("Put job (#%d) onto %s", id, tube), i)
 			}
 		},
 	})
 }
 
-func (c *cli) addStatsCmd() {
+func (c *cli) addPauseCmd() {
 	c.shell.AddCmd(&ishell.Cmd{
-		Name:     "stats",
-		Help:     "display server statistics",
-		LongHelp: helpStats,
+		Name:      "pause",
+		Help:      "pause tubes",
+		LongHelp:  helpPause,
+		Completer: c.listTubes,
 		Func: func(i *ishell.Context) {
-			stats, err := c.server.Stats()
+			if len(i.Args) != 2 {
+				outputError(errors.New("wrong number of arguments provided"), i)
+				return
+			}
+
+			d, err := time.ParseDuration(i.Args[1])
 			if err != nil {
 				outputError(err, i)
 				return
 			}
-
-			cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
-			var sb strings.Builder
-			for _, key := range sortedMapKeys(stats) {
-				sb.WriteString(fmt.Sprintf("%s: %s\n", cyan(key), stats[key]))
+			if d < time.Second {
+				outputError(errors.New("tubes can only be paused for a second or more"), i)
+				return
 			}
-			outputPaged(sb.String(), i)
+
+			c.pause(i, i.Args[0], d)
 		},
 	})
 }
 
-func (c *cli) addStatsJobCmd() {
+func (c *cli) addTrackCmd() {
 	c.shell.AddCmd(&ishell.Cmd{
-		Name:     "stats-job",
-		Aliases:  []string{"sj"},
-		Help:     "prints the stats for a job",
-		LongHelp: helpStatsJob,
+		Name:     "track",
+		Help:     "follow jobs, recording their timelines",
+		LongHelp: helpTrack,
 		Func: func(i *ishell.Context) {
-			var toStatStr string
-			if len(i.Args) == 1 {
-				toStatStr = i.Args[0]
-			} else {
-				outputError(errors.New("wrong number of arguments provided"), i)
+			var output bytes.Buffer
+			flags := flag.NewFlagSet("track", flag.ContinueOnError)
+			flags.SetOutput(&output)
+			interval := flags.Duration("interval", time.Second, "How often to poll the jobs' stats")
+			jsonFile := flags.String("json", "", "File to write the timeline to, as JSON")
+
+			args, err := parseFlags(flags, &output, i.Args)
+			if err != nil {
+				outputError(err, i)
 				return
 			}
+			i.Args = args
 
-			toStat, err := strconv.ParseUint(toStatStr, 10, 64)
+			ids, err := getJobsFromArgs(i)
 			if err != nil {
 				outputError(err, i)
 				return
 			}
+			ids = uniqueJobs(ids)
+			if *interval <= 0 {
+				outputError(errors.New("interval must be positive"), i)
+				return
+			}
 
-			if stats, err := c.server.StatsJob(toStat); err != nil {
-				outputError(err, i)
-			} else {
-				cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
-				var sb strings.Builder
-				for _, key := range sortedMapKeys(stats) {
-					sb.WriteString(fmt.Sprintf("%s: %s\n", cyan(key), stats[key]))
+			ctx, cancel := c.interruptible()
+			defer cancel()
+
+			t := newTracker()
+			active := ids
+		poll:
+			for len(active) > 0 {
+				pollCtx, pollCancel := c.server.withTimeout(ctx)
+				stats := make([]map[string]string, len(active))
+				errs := c.server.parallel(pollCtx, len(active), func(conn *server, n int) error {
+					var err error
+					stats[n], err = conn.StatsJob(pollCtx, active[n])
+					return err
+				})
+				pollCancel()
+				if ctx.Err() != nil {
+					break
+				}
+
+				now := time.Now()
+				var still []uint64
+				for n, id := range active {
+					switch {
+					case isNotFound(errs[n]) && t.seen(id):
+						outputTrackEvent(t.deleted(id, now), i)
+					case isNotFound(errs[n]):
+						outputError(fmt.Errorf("Job #%d not found", id), i)
+					case errs[n] != nil:
+						outputError(fmt.Errorf("Job #%d: %w", id, errs[n]), i)
+						break poll
+					default:
+						for _, e := range t.update(id, stats[n], now) {
+							outputTrackEvent(e, i)
+						}
+						still = append(still, id)
+					}
+				}
+				active = still
+
+				select {
+				case <-ctx.Done():
+					break poll
+				case <-time.After(*interval):
+				}
+			}
+
+			if len(t.events) == 0 {
+				return
+			}
+			i.Println()
+			i.Print(t.timeline(ids))
+
+			if *jsonFile != "" {
+				data, err := json.MarshalIndent(t.events, "", "  ")
+				if err == nil {
+					err = os.WriteFile(*jsonFile, append(data, '\n'), 0600)
+				}
+				if err != nil {
+					outputError(err, i)
+				} else {
+					outputInfo(fmt.Sprintf("Wrote %d events to %s", len(t.events), *jsonFile), i)
 				}
-				outputPaged(sb.String(), i)
 			}
 		},
 	})
 }
 
-func (c *cli) addStatsTubeCmd() {
+func outputTrackEvent(e trackEvent, i *ishell.Context) {
+	cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+	i.Println(fmt.Sprintf("%s  %s  %s", e.At.Format("15:04:05.000"), cyan(fmt.Sprintf("Job #%d", e.Job)), e))
+}
+
+func (c *cli) addUnpauseCmd() {
 	c.shell.AddCmd(&ishell.Cmd{
-		Name:      "stats-tube",
-		Aliases:   []string{"st"},
-		Help:      "stats the current tube",
-		LongHelp:  helpStatsTube,
+		Name:      "unpause",
+		Help:      "unpause tubes",
+		LongHelp:  helpUnpause,
 		Completer: c.listTubes,
 		Func: func(i *ishell.Context) {
-			tube, err := getTubeFromArgs(c, i)
+			if len(i.Args) != 1 {
+				outputError(errors.New("wrong number of arguments provided"), i)
+				return
+			}
+
+			c.pause(i, i.Args[0], 0)
+		},
+	})
+}
+
+// pause pauses the tubes matching pattern for d, or unpauses them when d is 0.
+func (c *cli) pause(i *ishell.Context, pattern string, d time.Duration) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	tubes, err := c.matchTubes(ctx, pattern)
+	if err != nil {
+		outputError(err, i)
+		return
+	}
+
+	for _, tube := range tubes {
+		if err := c.server.Pause(ctx, tube, d); isNotFound(err) {
+			outputError(fmt.Errorf("Tube %s not found", tube), i)
+		} else if err != nil {
+			outputError(err, i)
+			return
+		} else if d == 0 {
+			outputInfo(fmt.Sprintf("Unpaused tube %s", tube), i)
+		} else {
+			outputInfo(fmt.Sprintf("Paused tube %s for %s", tube, d), i)
+		}
+	}
+}
+
+func (c *cli) addPeekJobCmd() {
+	c.shell.AddCmd(&ishell.Cmd{
+		Name:      "peek",
+		Aliases:   []string{"p"},
+		Help:      "peek at the given job",
+		LongHelp:  helpPeekJob,
+		Completer: func(args []string) []string { return []string{} },
+		Func: func(i *ishell.Context) {
+			opts, args, err := parseBodyFlags("peek", i.Args)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+			i.Args = args
+
+			job, err := getJobFromArgs(c, i)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			ctx, cancel := c.context()
+			defer cancel()
+
+			jobDetails, err := c.server.PeekJob(ctx, job)
 			if err != nil {
 				outputError(err, i)
 				return
 			}
 
-			if stats, err := c.server.StatsTube(tube); err != nil {
+			if details, err := c.renderJob(ctx, job, "", jobDetails, opts); err != nil {
 				outputError(err, i)
 			} else {
-				cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
-				var sb strings.Builder
-				for _, key := range sortedMapKeys(stats) {
-					sb.WriteString(fmt.Sprintf("%s: %s\n", cyan(key), stats[key]))
-				}
-				outputPaged(sb.String(), i)
+				outputPaged(details, i)
 			}
 		},
 	})
 }
 
-func (c *cli) addUseTubeCmd() {
+func (c *cli) addPeekCmd(state string) {
 	c.shell.AddCmd(&ishell.Cmd{
-		Name:      "use",
-		Aliases:   []string{"ut"},
-		Help:      "use a tube",
-		LongHelp:  helpUse,
+		Name:      fmt.Sprintf("peek-%s", state),
+		Aliases:   []string{fmt.Sprintf("p%c", state[0])},
+		Help:      fmt.Sprintf("peek at %s jobs", state),
+		LongHelp:  fmt.Sprintf(helpPeek, state, state, state[0]),
 		Completer: c.listTubes,
 		Func: func(i *ishell.Context) {
-			if len(i.Args) == 0 {
-				outputError(errors.New("tube required"), i)
+			opts, args, err := parseBodyFlags(fmt.Sprintf("peek-%s", state), i.Args)
+			if err != nil {
+				outputError(err, i)
 				return
 			}
+			i.Args = args
 
 			tube, err := getTubeFromArgs(c, i)
 			if err != nil {
 				outputError(err, i)
 				return
 			}
-			c.server.UseTube(tube)
-			c.setPrompt()
-		},
+
+			ctx, cancel := c.context()
+			defer cancel()
+
+			id, body, err := c.server.Peek(ctx, state, tube)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			if details, err := c.renderJob(ctx, id, tube, body, opts); err != nil {
+				outputError(err, i)
+			} else {
+				outputPaged(details, i)
+			}
+		},
+	})
+}
+
+func (c *cli) addPutCmd() {
+	c.shell.AddCmd(&ishell.Cmd{
+		Name:      "put",
+		Help:      "puts data on the current tube",
+		LongHelp:  helpPut,
+		Completer: c.listTubes,
+		Func: func(i *ishell.Context) {
+			tube, err := getTubeFromArgs(c, i)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			schema, err := c.config.schemaFor(tube)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+			md, err := c.config.protobufFor(tube)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			temp, err := ioutil.TempFile(os.TempDir(), "beany")
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+			defer os.Remove(temp.Name())
+
+			editor := os.Getenv("EDITOR")
+			if editor == "" {
+				editor = "vi"
+			}
+
+			var job, encoded []byte
+			for {
+				if err := launch(editor, temp.Name()); err != nil {
+					outputError(err, i)
+					return
+				}
+
+				if job, err = ioutil.ReadFile(temp.Name()); err != nil {
+					outputError(err, i)
+					return
+				}
+
+				if len(job) == 0 {
+					outputError(errors.New("no data in job, not adding to tube"), i)
+					return
+				}
+
+				encoded = job
+				if md != nil {
+					if encoded, err = encodeProtobuf(md, job); err != nil {
+						outputError(err, i)
+						return
+					}
+				}
+
+				if schema == nil {
+					break
+				}
+				// Protobuf is checked as it decodes, as for validate
+				errs := validateBody(schema, job)
+				if md != nil {
+					errs = c.config.validateJob(schema, tube, encoded)
+				}
+				if len(errs) == 0 {
+					break
+				}
+				for _, err := range errs {
+					outputError(err, i)
+				}
+				if !c.getConfirmation("Job doesn't match the schema, edit it again", i) {
+					outputError(errors.New("job doesn't match the schema, not adding to tube"), i)
+					return
+				}
+			}
+
+			ctx, cancel := c.context()
+			defer cancel()
+
+			if id, err := c.server.Put(ctx, encoded, tube); err != nil {
+				outputError(err, i)
+			} else {
+				outputInfo(fmt.Sprintf("Put job (#%d) onto %s", id, tube), i)
+			}
+		},
+	})
+}
+
+func (c *cli) addSaveCmd() {
+	c.shell.AddCmd(&ishell.Cmd{
+		Name:      "save",
+		Help:      "save a job's body to a file",
+		LongHelp:  helpSave,
+		Completer: func(args []string) []string { return []string{} },
+		Func: func(i *ishell.Context) {
+			var output bytes.Buffer
+			flags := flag.NewFlagSet("save", flag.ContinueOnError)
+			flags.SetOutput(&output)
+			unredacted := flags.Bool("unredacted", false, "Save the body without redacting it, if allowed")
+
+			args, err := parseFlags(flags, &output, i.Args)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+			i.Args = args
+
+			var file string
+			if len(i.Args) == 2 {
+				file = i.Args[1]
+				i.Args = i.Args[:1]
+			}
+
+			job, err := getJobFromArgs(c, i)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			ctx, cancel := c.context()
+			defer cancel()
+
+			body, err := c.server.PeekJob(ctx, job)
+			if err == nil {
+				body, err = c.exportBody(ctx, job, body, *unredacted)
+			}
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			if file == "" {
+				file = fmt.Sprintf("job-%d%s", job, bodyExtensions[contentType(body)])
+			}
+			if err := writeBody(file, body); err != nil {
+				outputError(err, i)
+				return
+			}
+			outputInfo(fmt.Sprintf("Saved job #%d to %s (%d bytes)", job, file, len(body)), i)
+		},
+	})
+}
+
+func (c *cli) addSaveStateCmd() {
+	states := []string{"buried", "delayed", "ready"}
+
+	c.shell.AddCmd(&ishell.Cmd{
+		Name:     "save-state",
+		Help:     "save the bodies of jobs in a state to a directory",
+		LongHelp: helpSaveState,
+		Completer: func(args []string) []string {
+			if len(args) == 0 {
+				return states
+			}
+			return c.listTubes(args)
+		},
+		Func: func(i *ishell.Context) {
+			var output bytes.Buffer
+			flags := flag.NewFlagSet("save-state", flag.ContinueOnError)
+			flags.SetOutput(&output)
+			limit := flags.Int("limit", 100, "Most jobs to save")
+			unredacted := flags.Bool("unredacted", false, "Save the bodies without redacting them, if allowed")
+
+			args, err := parseFlags(flags, &output, i.Args)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+			if len(args) != 3 {
+				outputError(errors.New("expected a state, tube and directory"), i)
+				return
+			}
+			state, tube, dir := args[0], args[1], args[2]
+
+			if !slices.Contains(states, state) {
+				outputError(fmt.Errorf("unknown state '%s', expected one of %s", state, strings.Join(states, ", ")), i)
+				return
+			}
+			if *limit < 1 {
+				outputError(errors.New("limit must be at least 1"), i)
+				return
+			}
+
+			ctx, cancel := c.context()
+			defer cancel()
+
+			ids, total, err := c.server.jobsInState(ctx, state, tube, *limit)
+			if isNotFound(err) || err == nil && total == 0 {
+				outputError(fmt.Errorf("no %s jobs on tube %s", state, tube), i)
+				return
+			} else if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			r, err := c.redaction(ctx, tube, *unredacted, fmt.Sprintf("saved %s jobs from %s", state, tube))
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				outputError(err, i)
+				return
+			}
+
+			var saved, gone, failed int
+			errs := c.server.parallel(ctx, len(ids), func(conn *server, n int) error {
+				body, err := conn.PeekJob(ctx, ids[n])
+				if err != nil {
+					return err
+				}
+				if r != nil {
+					if body, err = c.config.redactBody(r, tube, body); err != nil {
+						return err
+					}
+				}
+				file := filepath.Join(dir, fmt.Sprintf("job-%d%s", ids[n], bodyExtensions[contentType(body)]))
+				return writeBody(file, body)
+			})
+			for n, err := range errs {
+				if err == nil {
+					saved++
+				} else if isNotFound(err) {
+					gone++
+				} else {
+					failed++
+					outputError(fmt.Errorf("Job #%d: %w", ids[n], err), i)
+				}
+			}
+
+			outputInfo(fmt.Sprintf("Saved %d of the %d %s jobs on %s to %s, %d gone, %d failed", saved, total, state, tube, dir, gone, failed), i)
+			if err := partialScan(len(ids), total, *limit, state); err != nil {
+				outputError(err, i)
+			}
+		},
+	})
+}
+
+func (c *cli) addSetCmd() {
+	c.shell.AddCmd(&ishell.Cmd{
+		Name:     "set",
+		Help:     "change a setting",
+		LongHelp: helpSet,
+		Completer: func(args []string) []string {
+			if len(args) == 0 {
+				return sortedMapKeys(c.settings())
+			}
+			return []string{}
+		},
+		Func: func(i *ishell.Context) {
+			settings := c.settings()
+
+			if len(i.Args) == 0 {
+				var sb strings.Builder
+				cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+				for _, key := range sortedMapKeys(settings) {
+					sb.WriteString(fmt.Sprintf("%s: %s\n", cyan(key), settings[key].get()))
+				}
+				i.Print(sb.String())
+				return
+			} else if len(i.Args) != 2 {
+				outputError(errors.New("wrong number of arguments provided"), i)
+				return
+			}
+
+			s, ok := settings[i.Args[0]]
+			if !ok {
+				outputError(fmt.Errorf("unknown setting '%s'", i.Args[0]), i)
+				return
+			}
+
+			if err := s.set(i.Args[1]); err != nil {
+				outputError(err, i)
+				return
+			}
+			outputInfo(fmt.Sprintf("Set %s to %s", i.Args[0], s.get()), i)
+		},
+	})
+}
+
+func (c *cli) addStatsCmd() {
+	c.shell.AddCmd(&ishell.Cmd{
+		Name:     "stats",
+		Help:     "display server statistics",
+		LongHelp: helpStats,
+		Func: func(i *ishell.Context) {
+			ctx, cancel := c.context()
+			defer cancel()
+
+			stats, err := c.server.Stats(ctx)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+			var sb strings.Builder
+			for _, key := range sortedMapKeys(stats) {
+				sb.WriteString(fmt.Sprintf("%s: %s\n", cyan(key), stats[key]))
+			}
+			outputPaged(sb.String(), i)
+		},
+	})
+}
+
+func (c *cli) addStatsJobCmd() {
+	c.shell.AddCmd(&ishell.Cmd{
+		Name:     "stats-job",
+		Aliases:  []string{"sj"},
+		Help:     "prints the stats for a job",
+		LongHelp: helpStatsJob,
+		Func: func(i *ishell.Context) {
+			var output bytes.Buffer
+			flags := flag.NewFlagSet("stats-job", flag.ContinueOnError)
+			flags.SetOutput(&output)
+			watch := flags.Bool("watch", false, "Keep refreshing the job's stats")
+			interval := flags.Duration("interval", time.Second, "How often to refresh with --watch")
+
+			args, err := parseFlags(flags, &output, i.Args)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+			if len(args) != 1 {
+				outputError(errors.New("wrong number of arguments provided"), i)
+				return
+			}
+
+			toStat, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			if *watch {
+				if *interval <= 0 {
+					outputError(errors.New("interval must be positive"), i)
+					return
+				}
+				c.watch(i, *interval, func(ctx context.Context) (string, error) {
+					card, err := c.jobCard(ctx, toStat)
+					if isNotFound(err) {
+						return "", fmt.Errorf("Job #%d has gone, deleted or never existed", toStat)
+					}
+					return card, err
+				})
+				return
+			}
+
+			ctx, cancel := c.context()
+			defer cancel()
+
+			if card, err := c.jobCard(ctx, toStat); err != nil {
+				outputError(err, i)
+			} else {
+				outputPaged(card, i)
+			}
+		},
+	})
+}
+
+func (c *cli) addStatsTubeCmd() {
+	c.shell.AddCmd(&ishell.Cmd{
+		Name:      "stats-tube",
+		Aliases:   []string{"st"},
+		Help:      "stats the current tube",
+		LongHelp:  helpStatsTube,
+		Completer: c.listTubes,
+		Func: func(i *ishell.Context) {
+			tube, err := getTubeFromArgs(c, i)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			ctx, cancel := c.context()
+			defer cancel()
+
+			if stats, err := c.server.StatsTube(ctx, tube); err != nil {
+				outputError(err, i)
+			} else {
+				cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+				var sb strings.Builder
+				for _, key := range sortedMapKeys(stats) {
+					sb.WriteString(fmt.Sprintf("%s: %s\n", cyan(key), stats[key]))
+				}
+				outputPaged(sb.String(), i)
+			}
+		},
+	})
+}
+
+func (c *cli) addUseTubeCmd() {
+	c.shell.AddCmd(&ishell.Cmd{
+		Name:      "use",
+		Aliases:   []string{"ut"},
+		Help:      "use a tube",
+		LongHelp:  helpUse,
+		Completer: c.listTubes,
+		Func: func(i *ishell.Context) {
+			if len(i.Args) == 0 {
+				outputError(errors.New("tube required"), i)
+				return
+			}
+
+			tube, err := getTubeFromArgs(c, i)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+			c.server.UseTube(tube)
+			c.setPrompt()
+		},
+	})
+}
+
+func (c *cli) addValidateCmd() {
+	c.shell.AddCmd(&ishell.Cmd{
+		Name:      "validate",
+		Help:      "check jobs on a tube match its schema",
+		LongHelp:  helpValidate,
+		Completer: c.listTubes,
+		Func: func(i *ishell.Context) {
+			var output bytes.Buffer
+			flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+			flags.SetOutput(&output)
+			limit := flags.Int("limit", 1000, "Most jobs to check in each state")
+
+			args, err := parseFlags(flags, &output, i.Args)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+			i.Args = args
+
+			tube, err := getTubeFromArgs(c, i)
+			if err != nil {
+				outputError(err, i)
+				return
+			}
+
+			schema, err := c.config.schemaFor(tube)
+			if err != nil {
+				outputError(err, i)
+				return
+			} else if schema == nil {
+				outputError(fmt.Errorf("no schema for tube %s", tube), i)
+				return
+			}
+
+			ctx, cancel := c.context()
+			defer cancel()
+
+			var checked, invalid, total int
+			var partial bool
+			for _, state := range []string{"ready", "buried"} {
+				ids, n, err := c.server.jobsInState(ctx, state, tube, *limit)
+				if isNotFound(err) {
+					continue
+				} else if err != nil {
+					outputError(err, i)
+					return
+				}
+				total += n
+				if err := partialScan(len(ids), n, *limit, state); err != nil {
+					outputError(err, i)
+					partial = true
+				}
+
+				jobErrs := make([][]schemaError, len(ids))
+				errs := c.server.parallel(ctx, len(ids), func(conn *server, n int) error {
+					body, err := conn.PeekJob(ctx, ids[n])
+					if err == nil {
+						jobErrs[n] = c.config.validateJob(schema, tube, body)
+					}
+					return err
+				})
+				for n, err := range errs {
+					if isNotFound(err) {
+						continue
+					} else if err != nil {
+						outputError(fmt.Errorf("Job #%d: %w", ids[n], err), i)
+						continue
+					}
+
+					checked++
+					if len(jobErrs[n]) > 0 {
+						invalid++
+					}
+					for _, jobErr := range jobErrs[n] {
+						outputError(fmt.Errorf("Job #%d (%s): %w", ids[n], state, jobErr), i)
+					}
+				}
+			}
+
+			summary := fmt.Sprintf("Checked %d of the %d ready and buried jobs on %s, %d don't match the schema", checked, total, tube, invalid)
+			if partial {
+				summary += ", but not every job could be found"
+			}
+			outputInfo(summary, i)
+		},
 	})
 }
 
@@ -519,6 +1335,120 @@ func (c *cli) addVersionCmd() {
 	})
 }
 
+// context returns the context for a single command. It is bounded by the
+// configured timeout and cancelled if the user interrupts the command.
+func (c *cli) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := c.server.withTimeout(context.Background())
+
+	c.cancelMu.Lock()
+	c.cancel = cancel
+	c.cancelMu.Unlock()
+
+	return ctx, func() {
+		c.cancelMu.Lock()
+		c.cancel = nil
+		c.cancelMu.Unlock()
+		cancel()
+	}
+}
+
+// interruptible returns a context without a timeout, for commands which run
+// until Ctrl-C.
+func (c *cli) interruptible() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.cancelMu.Lock()
+	c.cancel = cancel
+	c.cancelMu.Unlock()
+
+	return ctx, func() {
+		c.cancelMu.Lock()
+		c.cancel = nil
+		c.cancelMu.Unlock()
+		cancel()
+	}
+}
+
+// interrupt cancels the command in flight, returning false if there is none.
+func (c *cli) interrupt() bool {
+	c.cancelMu.Lock()
+	defer c.cancelMu.Unlock()
+
+	if c.cancel == nil {
+		return false
+	}
+	c.cancel()
+	return true
+}
+
+// handleInterrupts makes Ctrl-C cancel the command in flight and return to the
+// prompt, rather than killing beany.
+func (c *cli) handleInterrupts() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		for range sigs {
+			if !c.interrupt() && !c.shell.Active() {
+				os.Exit(130)
+			}
+		}
+	}()
+
+	c.shell.Interrupt(func(i *ishell.Context, count int, input string) {
+		if c.interrupt() {
+			return
+		}
+
+		if count >= 2 {
+			i.Println("Interrupted")
+			os.Exit(1)
+		}
+		i.Println("Input Ctrl-c once more to exit")
+	})
+}
+
+type setting struct {
+	get func() string
+	set func(string) error
+}
+
+func (c *cli) settings() map[string]setting {
+	return map[string]setting{
+		"heartbeat": {
+			get: func() string {
+				return c.server.getHeartbeat().String()
+			},
+			set: func(value string) error {
+				heartbeat, err := time.ParseDuration(value)
+				if err != nil {
+					return err
+				}
+				if heartbeat < 0 {
+					return errors.New("heartbeat can't be negative")
+				}
+				c.server.setHeartbeat(heartbeat)
+				return nil
+			},
+		},
+		"timeout": {
+			get: func() string {
+				return c.server.timeout.String()
+			},
+			set: func(value string) error {
+				timeout, err := time.ParseDuration(value)
+				if err != nil {
+					return err
+				}
+				if timeout < 0 {
+					return errors.New("timeout can't be negative")
+				}
+				c.server.timeout = timeout
+				return nil
+			},
+		},
+	}
+}
+
 func (c *cli) getConfirmation(msg string, i *ishell.Context) bool {
 	i.ShowPrompt(false)
 	defer c.shell.SetHomeHistoryPath(historyFile)
@@ -554,6 +1484,117 @@ func getJobFromArgs(c *cli, i *ishell.Context) (uint64, error) {
 	return 0, errors.New("too many arguments provided")
 }
 
+// getJobsFromArgs parses job ids and ranges of ids from the arguments, or
+// reads them from stdin given '-'.
+func getJobsFromArgs(i *ishell.Context) ([]uint64, error) {
+	if len(i.Args) == 0 {
+		return nil, errors.New("too few arguments provided")
+	}
+
+	if len(i.Args) == 1 && i.Args[0] == "-" {
+		return readJobs(i)
+	}
+
+	var ids []uint64
+	for _, arg := range i.Args {
+		for _, field := range strings.Split(arg, ",") {
+			if field == "" {
+				continue
+			}
+			parsed, err := parseJobs(field)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, parsed...)
+		}
+	}
+	return ids, nil
+}
+
+// uniqueJobs removes repeated ids, keeping the first of each.
+func uniqueJobs(ids []uint64) []uint64 {
+	seen := map[uint64]bool{}
+	var unique []uint64
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// maxJobRange limits the size of a range of ids, so a typo doesn't send
+// millions of commands
+const maxJobRange = 100000
+
+// parseJobs parses a job id, or a range of them as FIRST-LAST.
+func parseJobs(s string) ([]uint64, error) {
+	firstStr, lastStr, isRange := strings.Cut(strings.TrimPrefix(s, "#"), "-")
+
+	first, err := strconv.ParseUint(firstStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse job '%s'", s)
+	}
+	if !isRange {
+		return []uint64{first}, nil
+	}
+
+	last, err := strconv.ParseUint(lastStr, 10, 64)
+	if err != nil || last < first {
+		return nil, fmt.Errorf("unable to parse job range '%s'", s)
+	}
+	if last-first >= maxJobRange {
+		return nil, fmt.Errorf("job range '%s' is too large, at most %d jobs", s, maxJobRange)
+	}
+
+	var ids []uint64
+	for id := first; id <= last; id++ {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+var jobRef = regexp.MustCompile(`#(\d+)`)
+
+// readJobs reads job ids from stdin until an empty line. Lines referring to
+// jobs as #<JOB_ID>, like the output of other commands, give those jobs,
+// otherwise each field of the line is parsed as an id or range.
+func readJobs(i *ishell.Context) ([]uint64, error) {
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		outputInfo("Enter job ids, ending with an empty line", i)
+	}
+
+	var ids []uint64
+	lines := i.ReadMultiLinesFunc(func(line string) bool {
+		return strings.TrimSpace(line) != ""
+	})
+	for _, line := range strings.Split(lines, "\n") {
+		if refs := jobRef.FindAllStringSubmatch(line, -1); refs != nil {
+			for _, ref := range refs {
+				id, _ := strconv.ParseUint(ref[1], 10, 64)
+				ids = append(ids, id)
+			}
+			continue
+		}
+
+		for _, field := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}) {
+			parsed, err := parseJobs(field)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, parsed...)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, errors.New("no jobs given")
+	}
+	return ids, nil
+}
+
 func getTubeFromArgs(c *cli, i *ishell.Context) (string, error) {
 	if len(i.Args) == 0 {
 		return c.server.CurrentTubeName()
@@ -564,15 +1605,73 @@ func getTubeFromArgs(c *cli, i *ishell.Context) (string, error) {
 	return "", errors.New("too many arguments provided")
 }
 
+// matchTubes returns the tubes matching pattern, if it's a glob, otherwise
+// the tube it names.
+func (c *cli) matchTubes(ctx context.Context, pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid tube glob: %w", err)
+	}
+	if !strings.ContainsAny(pattern, "*?[\\") {
+		return []string{pattern}, nil
+	}
+
+	tubes, err := c.server.ListTubes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []string
+	for _, tube := range tubes {
+		if ok, _ := path.Match(pattern, tube); ok {
+			matched = append(matched, tube)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no tubes match '%s'", pattern)
+	}
+	return matched, nil
+}
+
+// pauseLeft formats the time left before a paused tube is unpaused, or is
+// empty if the tube isn't paused.
+func pauseLeft(stats map[string]string) string {
+	left, _ := strconv.Atoi(stats["pause-time-left"])
+	if left <= 0 {
+		return ""
+	}
+	return (time.Duration(left) * time.Second).String()
+}
+
 func (c *cli) listTubes([]string) []string {
-	tubes, err := c.server.ListTubes()
+	c.tubesMu.Lock()
+	defer c.tubesMu.Unlock()
+
+	if time.Since(c.tubesAge) < tubesCacheTTL {
+		return c.tubes
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	tubes, err := c.server.ListTubes(ctx)
 	if err != nil {
 		return nil
 	}
 
+	c.tubes = tubes
+	c.tubesAge = time.Now()
 	return tubes
 }
 
+// forgetTubes clears the cached tube names, as when connecting elsewhere.
+func (c *cli) forgetTubes() {
+	c.tubesMu.Lock()
+	defer c.tubesMu.Unlock()
+
+	c.tubes = nil
+	c.tubesAge = time.Time{}
+}
+
 func outputConnectionInfo(c *cli, i *ishell.Context) {
 	if s, err := c.server.ConnectionStr(); err != nil {
 		outputError(err, i)
@@ -617,7 +1716,12 @@ func (c *cli) setPrompt() {
 	boldRed := color.New(color.FgRed, color.Bold).SprintFunc()
 
 	var prompt string
-	if c.server.isConnected() {
+	if c.server.isConnected() && c.server.isStale() {
+		tube, _ := c.server.CurrentTubeName()
+
+		prompt = fmt.Sprintf("%s%s %s%s",
+			yellow("["), boldMagenta(tube), boldRed("(reconnecting)"), yellow("] >>> "))
+	} else if c.server.isConnected() {
 		tube, _ := c.server.CurrentTubeName()
 
 		prompt = fmt.Sprintf("%s%s%s",
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configFile = ".beany.yaml"
+)
+
+type config struct {
+	// AuditLog is the file changes to servers are recorded in, if any
+	AuditLog string `yaml:"audit_log"`
+
+	// MaintenanceFile records the state of tubes paused for maintenance
+	MaintenanceFile string `yaml:"maintenance_file"`
+
+	// ListTubes are the defaults for list-tubes
+	ListTubes listTubesOptions `yaml:"list_tubes"`
+
+	// Decoders pick how job bodies are decoded on tubes, rather than
+	// detecting their format
+	Decoders []decoderRule `yaml:"decoders"`
+
+	// MaxBodySize is how much of a job's body is shown, in bytes, or 0 to
+	// show bodies in full
+	MaxBodySize int `yaml:"max_body_size"`
+
+	// Redact hides parts of job bodies on tubes, e.g. emails
+	Redact []redactRule `yaml:"redact"`
+
+	// Schemas are the JSON Schemas job bodies on tubes should conform to
+	Schemas []schemaRule `yaml:"schemas"`
+
+	// Viewers are the commands open uses for bodies of each content type,
+	// e.g. json: jq .
+	Viewers map[string]string `yaml:"viewers"`
+
+	// Protobuf gives the message types of protobuf encoded bodies on tubes
+	Protobuf []protobufRule `yaml:"protobuf"`
+
+	Profiles map[string]profile `yaml:"profiles"`
+}
+
+type profile struct {
+	// Connect is the server to connect to, in any form accepted by -connect
+	Connect string `yaml:"connect"`
+
+	// ReadOnly prevents changes to the server, e.g. deleting jobs
+	ReadOnly bool `yaml:"read_only"`
+
+	// AllowUnredacted allows job bodies to be shown unredacted with
+	// --unredacted
+	AllowUnredacted bool `yaml:"allow_unredacted"`
+
+	// ListTubes are the defaults for list-tubes on this server
+	ListTubes listTubesOptions `yaml:"list_tubes"`
+
+	transport `yaml:",inline"`
+}
+
+// loadConfig reads the config file at path, or ~/.beany.yaml if path is
+// empty. A missing default config file is not an error.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{MaintenanceFile: maintenanceFile, MaxBodySize: maxBodySize}
+
+	explicit := path != ""
+	if !explicit {
+		home := os.Getenv("HOME")
+		if runtime.GOOS == "windows" {
+			home = os.Getenv("USERPROFILE")
+		}
+		path = filepath.Join(home, configFile)
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config '%s': %w", path, err)
+	}
+	return cfg, nil
+}
+
+// profile returns the named profile.
+func (c *config) profile(name string) (profile, error) {
+	p, ok := c.Profiles[name]
+	if !ok {
+		return profile{}, fmt.Errorf("no profile named '%s'", name)
+	}
+	return p, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type consumer struct {
+	tube       string
+	command    []string
+	release    map[int]bool
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	deleted, released, buried atomic.Int64
+}
+
+func runConsume(e env, args []string) error {
+	flags := flag.NewFlagSet("consume", flag.ExitOnError)
+	concurrency := flags.Int("concurrency", 1, "Number of jobs to handle at once")
+	releaseCodes := flags.String("release", "75", "Handler exit codes which release the job to be retried, comma separated")
+	backoff := flags.Duration("backoff", 5*time.Second, "Delay before retrying a released job, doubling with each release")
+	maxBackoff := flags.Duration("max-backoff", 10*time.Minute, "Longest delay before retrying a released job")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: beany consume [options] <tube> -- <command> [args...]")
+		flags.PrintDefaults()
+	}
+
+	// Options may be given either side of the tube
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no tube given")
+	}
+	tube := flags.Arg(0)
+	flags.Parse(flags.Args()[1:])
+	command := flags.Args()
+	if len(command) == 0 {
+		flags.Usage()
+		return errors.New("no command given")
+	}
+
+	c := &consumer{
+		tube:       tube,
+		command:    command,
+		release:    map[int]bool{},
+		backoff:    *backoff,
+		maxBackoff: *maxBackoff,
+	}
+	for _, code := range strings.Split(*releaseCodes, ",") {
+		if code = strings.TrimSpace(code); code == "" {
+			continue
+		}
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			return fmt.Errorf("unable to parse release code '%s'", code)
+		}
+		c.release[n] = true
+	}
+
+	// Each worker reserves on its own connection, as only that connection
+	// can touch, release or delete the job. Jobs are recorded in the audit
+	// log as a whole rather than individually.
+	var workers []*server
+	for i := 0; i < *concurrency; i++ {
+		s := e.newServer(append(e.target, WithHeartbeat(0), WithAuditLog(nil))...)
+		if s.readOnly {
+			return errReadOnly
+		}
+		if err := s.ensureConnected(context.Background()); err != nil {
+			return err
+		}
+		workers = append(workers, s)
+	}
+
+	// The first signal stops reserving jobs, waiting for handlers to finish,
+	// the second kills them
+	stopping := make(chan struct{})
+	handlers, kill := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("stopping, waiting for handlers to finish")
+		close(stopping)
+		<-signals
+		log.Printf("killing handlers")
+		kill()
+	}()
+
+	connection, _ := workers[0].ConnectionStr()
+	log.Printf("consuming jobs from %s with %d workers", tube, *concurrency)
+
+	var wg sync.WaitGroup
+	for _, s := range workers {
+		wg.Add(1)
+		go func(s *server) {
+			defer wg.Done()
+			defer s.Disconnect()
+			c.work(handlers, s, stopping)
+		}(s)
+	}
+	wg.Wait()
+
+	summary := fmt.Sprintf("consumed jobs from tube %s: %d deleted, %d released, %d buried",
+		tube, c.deleted.Load(), c.released.Load(), c.buried.Load())
+	log.Print(summary)
+
+	audit := e.newServer(e.target...).audit
+	return audit.record(context.Background(), connection, "%s", summary)
+}
+
+func (c *consumer) work(handlers context.Context, s *server, stopping chan struct{}) {
+	for {
+		select {
+		case <-stopping:
+			return
+		default:
+		}
+
+		ctx, cancel := s.withTimeout(context.Background())
+		id, body, err := s.Reserve(ctx, time.Second, c.tube)
+		cancel()
+		if isReserveTimeout(err) {
+			continue
+		} else if err != nil {
+			log.Printf("unable to reserve job: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if err := c.handle(handlers, s, id, body); err != nil {
+			log.Printf("job #%d: %s", id, err)
+		}
+	}
+}
+
+// handle runs the command for the job, then deletes, releases or buries it
+// depending on how it exits.
+func (c *consumer) handle(handlers context.Context, s *server, id uint64, body []byte) error {
+	ctx, cancel := s.withTimeout(context.Background())
+	stats, err := s.StatsJob(ctx, id)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(handlers, c.command[0], c.command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), jobEnv(id, stats)...)
+	detach(cmd)
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return c.bury(s, id, stats, err.Error())
+	}
+
+	// Keep the job reserved for as long as the handler runs
+	done := make(chan struct{})
+	ttr, _ := strconv.Atoi(stats["ttr"])
+	go func() {
+		ticker := time.NewTicker(max(time.Duration(ttr)*time.Second/2, 500*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := s.withTimeout(context.Background())
+				if err := s.Touch(ctx, id); err != nil {
+					log.Printf("job #%d: unable to touch: %s", id, err)
+				}
+				cancel()
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	close(done)
+	took := time.Since(start).Round(time.Millisecond)
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return c.bury(s, id, stats, err.Error())
+	}
+
+	code := cmd.ProcessState.ExitCode()
+	switch {
+	case code == 0:
+		ctx, cancel := s.withTimeout(context.Background())
+		defer cancel()
+		if err := s.Delete(ctx, id); err != nil {
+			return err
+		}
+		c.deleted.Add(1)
+		log.Printf("job #%d: deleted, took %s", id, took)
+	case c.release[code]:
+		return c.releaseJob(s, id, stats, code)
+	default:
+		return c.bury(s, id, stats, fmt.Sprintf("handler exited with %d after %s", code, took))
+	}
+	return nil
+}
+
+func (c *consumer) releaseJob(s *server, id uint64, stats map[string]string, code int) error {
+	releases, _ := strconv.Atoi(stats["releases"])
+	pri, _ := strconv.ParseUint(stats["pri"], 10, 32)
+
+	delay := c.backoff
+	for i := 0; i < releases && delay < c.maxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, c.maxBackoff)
+
+	ctx, cancel := s.withTimeout(context.Background())
+	defer cancel()
+	if err := s.Release(ctx, id, uint32(pri), delay); err != nil {
+		return err
+	}
+	c.released.Add(1)
+	log.Printf("job #%d: released with a %s delay, handler exited with %d", id, delay, code)
+	return nil
+}
+
+// bury buries the job, keeping its priority.
+func (c *consumer) bury(s *server, id uint64, stats map[string]string, reason string) error {
+	pri, _ := strconv.ParseUint(stats["pri"], 10, 32)
+
+	ctx, cancel := s.withTimeout(context.Background())
+	defer cancel()
+	if err := s.BuryJob(ctx, id, uint32(pri)); err != nil {
+		return err
+	}
+	c.buried.Add(1)
+	log.Printf("job #%d: buried, %s", id, reason)
+	return nil
+}
+
+// jobEnv describes the job to the handler, as BEANY_JOB_ID and a
+// BEANY_JOB_<STAT> variable for each of its stats.
+func jobEnv(id uint64, stats map[string]string) []string {
+	env := []string{fmt.Sprintf("BEANY_JOB_ID=%d", id)}
+	for _, key := range sortedMapKeys(stats) {
+		if key == "id" {
+			continue
+		}
+		name := "BEANY_JOB_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		env = append(env, name+"="+stats[key])
+	}
+	return env
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// decoder makes job bodies in a particular format readable. Encodings such as
+// gzip unwrap the body to be decoded again, formats such as JSON render it.
+type decoder struct {
+	// detect reports whether the body looks to be in this format
+	detect func(body []byte) bool
+
+	unwrap func(body []byte) ([]byte, error)
+	render func(body []byte) (string, error)
+
+	// value decodes structured formats, so they can be redacted
+	value func(body []byte) (interface{}, error)
+}
+
+var decoders = map[string]decoder{
+	"gzip":    {detect: hasPrefix(0x1f, 0x8b), unwrap: gunzip},
+	"zlib":    {detect: isZlib, unwrap: unzlib},
+	"zstd":    {detect: hasPrefix(0x28, 0xb5, 0x2f, 0xfd), unwrap: unzstd},
+	"json":    {detect: isJSON, render: renderJSON, value: decodeJSON},
+	"msgpack": {detect: isMsgpack, render: renderMsgpack, value: decodeMsgpack},
+	"php":     {detect: isPHPSerialized, render: renderPHPSerialized, value: unserializePHP},
+	"hex":     {render: renderHex},
+	"text":    {render: renderText},
+}
+
+func init() {
+	// Added here, as detecting base64 detects what it encodes
+	decoders["base64"] = decoder{detect: isBase64, unwrap: decodeBase64}
+}
+
+// detectOrder is the order formats are tried in when detecting them, with
+// the more certain first.
+var detectOrder = []string{"gzip", "zstd", "zlib", "json", "php", "msgpack", "base64"}
+
+// maxDecodeLayers limits how many encodings are unwrapped, e.g. base64 of gzip
+const maxDecodeLayers = 4
+
+// decodeBody renders the body readably, using the named decoders in order,
+// then detecting the format of whatever's left. It returns the decoders used.
+// Any redaction is applied to what's rendered.
+func decodeBody(body []byte, as []string, r *redaction) (string, []string, error) {
+	var used []string
+	for _, name := range as {
+		d, ok := decoders[name]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown decoder '%s', expected one of %s", name, strings.Join(sortedMapKeys(decoders), ", "))
+		}
+		used = append(used, name)
+
+		if d.render != nil {
+			rendered, err := renderRedacted(d, body, r)
+			if err != nil {
+				return "", nil, fmt.Errorf("unable to decode as %s: %w", name, err)
+			}
+			return rendered, used, nil
+		}
+
+		var err error
+		if body, err = d.unwrap(body); err != nil {
+			return "", nil, fmt.Errorf("unable to decode as %s: %w", name, err)
+		}
+	}
+
+	for layer := 0; layer < maxDecodeLayers; layer++ {
+		name, ok := detect(body)
+		if !ok {
+			break
+		}
+
+		d := decoders[name]
+		if d.render != nil {
+			if rendered, err := renderRedacted(d, body, r); err == nil {
+				return rendered, append(used, name), nil
+			}
+			break
+		}
+
+		unwrapped, err := d.unwrap(body)
+		if errors.Is(err, errDecompressedSize) {
+			return "", nil, fmt.Errorf("unable to decode as %s: %w, use --as hex to see it as it is", name, err)
+		} else if err != nil {
+			break
+		}
+		body = unwrapped
+		used = append(used, name)
+	}
+
+	if isText(body) {
+		rendered, _ := renderRedacted(decoders["text"], body, r)
+		return rendered, append(used, "text"), nil
+	}
+	rendered, _ := renderRedacted(decoders["hex"], body, r)
+	return rendered, append(used, "hex"), nil
+}
+
+// renderRedacted renders the body with the decoder, redacted if r isn't nil.
+func renderRedacted(d decoder, body []byte, r *redaction) (string, error) {
+	if r == nil {
+		return d.render(body)
+	}
+	if d.value != nil {
+		v, err := d.value(body)
+		if err != nil {
+			return "", err
+		}
+		return renderValue(r.value(v))
+	}
+
+	// Structured bodies still have their fields redacted, however they're
+	// rendered
+	if len(r.fields) > 0 {
+		return d.render(r.body(body))
+	}
+	return d.render(r.bytes(body))
+}
+
+func detect(body []byte) (string, bool) {
+	for _, name := range detectOrder {
+		if decoders[name].detect(body) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// decoderRule picks the decoders for the bodies of jobs on tubes matching
+// Tube, e.g. "gzip,json".
+type decoderRule struct {
+	Tube string `yaml:"tube"`
+	As   string `yaml:"as"`
+}
+
+// decodersFor returns the decoders configured for the tube, if any.
+func (c *config) decodersFor(tube string) []string {
+	for _, rule := range c.Decoders {
+		if ok, _ := path.Match(rule.Tube, tube); ok {
+			return splitDecoders(rule.As)
+		}
+	}
+	return nil
+}
+
+func splitDecoders(as string) []string {
+	var names []string
+	for _, name := range strings.Split(as, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func hasPrefix(prefix ...byte) func([]byte) bool {
+	return func(body []byte) bool {
+		return bytes.HasPrefix(body, prefix)
+	}
+}
+
+func isZlib(body []byte) bool {
+	return len(body) > 2 && body[0]&0x0f == 8 && (uint16(body[0])<<8|uint16(body[1]))%31 == 0
+}
+
+// maxDecompressedSize is the most a body is decompressed to, in bytes, so a
+// small body which decompresses to something huge can't exhaust memory.
+const maxDecompressedSize = 256 * maxBodySize
+
+var errDecompressedSize = errors.New("decompressed body too large")
+
+func gunzip(body []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readDecompressed(r)
+}
+
+func unzlib(body []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readDecompressed(r)
+}
+
+func unzstd(body []byte) ([]byte, error) {
+	r, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readDecompressed(r)
+}
+
+// readDecompressed reads a decompressed body, up to maxDecompressedSize.
+func readDecompressed(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(body) > maxDecompressedSize {
+		return nil, errDecompressedSize
+	}
+	return body, nil
+}
+
+// isBase64 reports whether the body is base64 of something else detectable,
+// as plenty of plain text is also valid base64.
+func isBase64(body []byte) bool {
+	if len(body) < 8 {
+		return false
+	}
+	decoded, err := decodeBase64(body)
+	if err != nil {
+		return false
+	}
+	_, ok := detect(decoded)
+	return ok
+}
+
+func decodeBase64(body []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(body))
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if decoded, err := enc.DecodeString(s); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, errors.New("not valid base64")
+}
+
+func isJSON(body []byte) bool {
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed)
+}
+
+func decodeJSON(body []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("more than one value")
+	}
+	return v, nil
+}
+
+func renderJSON(body []byte) (string, error) {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, bytes.TrimSpace(body), "", "  "); err != nil {
+		return "", err
+	}
+	return colourJSON(escapeText(indented.String())), nil
+}
+
+// renderValue renders a decoded value, such as from msgpack, as JSON.
+func renderValue(v interface{}) (string, error) {
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(jsonValue(v)); err != nil {
+		return "", err
+	}
+	return colourJSON(escapeText(strings.TrimSuffix(data.String(), "\n"))), nil
+}
+
+// jsonValue converts v to something which can be encoded as JSON, with string
+// map keys, and bytes as strings or base64.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonValue(e)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for n, e := range v {
+			v[n] = jsonValue(e)
+		}
+		return v
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return base64.StdEncoding.EncodeToString(v)
+	}
+	return v
+}
+
+// colourJSON colours indented JSON, keys in cyan, strings in green, numbers
+// in yellow, and true, false and null in magenta.
+func colourJSON(s string) string {
+	if color.NoColor {
+		return s
+	}
+
+	key := color.New(color.FgCyan)
+	str := color.New(color.FgGreen)
+	num := color.New(color.FgYellow)
+	lit := color.New(color.FgMagenta)
+
+	var out strings.Builder
+	for n := 0; n < len(s); {
+		switch ch := s[n]; {
+		case ch == '"':
+			end := n + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(s))
+
+			if strings.HasPrefix(strings.TrimLeft(s[end:], " "), ":") {
+				out.WriteString(key.Sprint(s[n:end]))
+			} else {
+				out.WriteString(str.Sprint(s[n:end]))
+			}
+			n = end
+		case ch == '-' || ch >= '0' && ch <= '9':
+			end := n + 1
+			for end < len(s) && strings.IndexByte("0123456789.eE+-", s[end]) >= 0 {
+				end++
+			}
+			out.WriteString(num.Sprint(s[n:end]))
+			n = end
+		case ch == 't' || ch == 'f' || ch == 'n':
+			end := n + 1
+			for end < len(s) && s[end] >= 'a' && s[end] <= 'z' {
+				end++
+			}
+			out.WriteString(lit.Sprint(s[n:end]))
+			n = end
+		default:
+			out.WriteByte(ch)
+			n++
+		}
+	}
+	return out.String()
+}
+
+// isMsgpack reports whether the body is a msgpack map or array, which decodes
+// without anything left over.
+func isMsgpack(body []byte) bool {
+	if len(body) == 0 {
+		return false
+	}
+	switch b := body[0]; {
+	case b >= 0x80 && b <= 0x9f, b >= 0xdc && b <= 0xdf:
+	default:
+		return false
+	}
+	_, err := decodeMsgpack(body)
+	return err == nil
+}
+
+func decodeMsgpack(body []byte) (interface{}, error) {
+	r := bytes.NewReader(body)
+	v, err := msgpack.NewDecoder(r).DecodeInterface()
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("%d bytes left over", r.Len())
+	}
+	return v, nil
+}
+
+func renderMsgpack(body []byte) (string, error) {
+	v, err := decodeMsgpack(body)
+	if err != nil {
+		return "", err
+	}
+	return renderValue(v)
+}
+
+func isPHPSerialized(body []byte) bool {
+	if len(body) < 2 || strings.IndexByte("aObsidN", body[0]) < 0 || body[1] != ':' && body[1] != ';' {
+		return false
+	}
+	_, err := unserializePHP(body)
+	return err == nil
+}
+
+func renderPHPSerialized(body []byte) (string, error) {
+	v, err := unserializePHP(body)
+	if err != nil {
+		return "", err
+	}
+	return renderValue(v)
+}
+
+// unserializePHP decodes a value serialized with PHP's serialize. Objects are
+// decoded as maps, with their class as "__class".
+func unserializePHP(body []byte) (interface{}, error) {
+	p := &phpParser{data: body}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.data) {
+		return nil, fmt.Errorf("%d bytes left over", len(p.data)-p.pos)
+	}
+	return v, nil
+}
+
+type phpParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *phpParser) value() (interface{}, error) {
+	if p.pos >= len(p.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	kind := p.data[p.pos]
+	if kind == 'N' {
+		return nil, p.expect("N;")
+	}
+	p.pos++
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case 'b':
+		s, err := p.until(';')
+		return s == "1", err
+	case 'i':
+		s, err := p.until(';')
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case 'd':
+		s, err := p.until(';')
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseFloat(s, 64)
+	case 's':
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return s, p.expect(";")
+	case 'a':
+		return p.array()
+	case 'O':
+		class, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.array()
+		if err != nil {
+			return nil, err
+		}
+
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			obj = map[string]interface{}{}
+		}
+		obj["__class"] = class
+		return obj, nil
+	}
+	return nil, fmt.Errorf("unsupported type '%c' at byte %d", kind, p.pos-2)
+}
+
+// array decodes n:{key;value...}, as a list if the keys are 0 to n-1.
+func (p *phpParser) array() (interface{}, error) {
+	countStr, err := p.until(':')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid length at byte %d", p.pos)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{}, count)
+	list := make([]interface{}, 0, count)
+	isList := true
+	for n := 0; n < count; n++ {
+		k, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+
+		if i, ok := k.(int64); !ok || i != int64(n) {
+			isList = false
+		}
+		m[fmt.Sprint(k)] = v
+		list = append(list, v)
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+
+	if isList {
+		return list, nil
+	}
+	return m, nil
+}
+
+// str decodes len:"...".
+func (p *phpParser) str() (string, error) {
+	lenStr, err := p.until(':')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(lenStr)
+	if err != nil || n < 0 || p.pos+n+2 > len(p.data) {
+		return "", fmt.Errorf("invalid string length at byte %d", p.pos)
+	}
+	if err := p.expect(`"`); err != nil {
+		return "", err
+	}
+	s := string(p.data[p.pos : p.pos+n])
+	p.pos += n
+	return s, p.expect(`"`)
+}
+
+func (p *phpParser) until(end byte) (string, error) {
+	n := bytes.IndexByte(p.data[p.pos:], end)
+	if n < 0 {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := string(p.data[p.pos : p.pos+n])
+	p.pos += n + 1
+	return s, nil
+}
+
+func (p *phpParser) expect(s string) error {
+	if !bytes.HasPrefix(p.data[p.pos:], []byte(s)) {
+		return fmt.Errorf("expected '%s' at byte %d", s, p.pos)
+	}
+	p.pos += len(s)
+	return nil
+}
+
+// isText reports whether the body is UTF-8 without control characters, other
+// than whitespace.
+func isText(body []byte) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+	for _, r := range string(body) {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func renderHex(body []byte) (string, error) {
+	return hex.Dump(body), nil
+}
+
+func renderText(body []byte) (string, error) {
+	return escapeText(string(body)), nil
+}
+
+// escapeText escapes anything which could change the terminal's state, such
+// as escape sequences, carriage returns and invalid UTF-8, keeping newlines
+// and tabs.
+func escapeText(s string) string {
+	var out strings.Builder
+	for n := 0; n < len(s); {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&out, `\x%02x`, s[n])
+		case r == '\n' || r == '\t' || unicode.IsGraphic(r):
+			out.WriteString(s[n : n+size])
+		case r < utf8.RuneSelf:
+			fmt.Fprintf(&out, `\x%02x`, r)
+		default:
+			fmt.Fprintf(&out, `\u%04x`, r)
+		}
+		n += size
+	}
+	return out.String()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats which only ever increase, exported as counters rather than gauges.
+var counterStats = regexp.MustCompile(`^(cmd-.*|total-.*|job-timeouts|rusage-.*)$`)
+
+// Stats describing the server or tube rather than measuring it, which aren't
+// exported even where they look numeric, such as a version of 1.12.
+var infoStats = regexp.MustCompile(`^(version|pid|id|hostname|os|platform|name)$`)
+
+type exporter struct {
+	env           env
+	include       *regexp.Regexp
+	exclude       *regexp.Regexp
+	scrapeTimeout time.Duration
+
+	mu      sync.Mutex
+	servers map[string]*server
+}
+
+func runExporter(e env, args []string) error {
+	flags := flag.NewFlagSet("exporter", flag.ExitOnError)
+	listen := flags.String("listen", ":9110", "Address to serve metrics on")
+	include := flags.String("tube-include", "", "Only export tubes matching this regex")
+	exclude := flags.String("tube-exclude", "", "Don't export tubes matching this regex")
+	scrapeTimeout := flags.Duration("scrape-timeout", 10*time.Second, "Timeout for collecting metrics")
+	flags.Parse(args)
+
+	x := &exporter{
+		env:           e,
+		scrapeTimeout: *scrapeTimeout,
+		servers:       map[string]*server{},
+	}
+
+	var err error
+	if *include != "" {
+		if x.include, err = regexp.Compile(*include); err != nil {
+			return fmt.Errorf("unable to parse tube-include: %w", err)
+		}
+	}
+	if *exclude != "" {
+		if x.exclude, err = regexp.Compile(*exclude); err != nil {
+			return fmt.Errorf("unable to parse tube-exclude: %w", err)
+		}
+	}
+
+	http.HandleFunc("/metrics", x.handleMetrics)
+
+	log.Printf("serving metrics on %s/metrics", *listen)
+	return http.ListenAndServe(*listen, nil)
+}
+
+// handleMetrics collects metrics for the server given by the target parameter,
+// or the server beany was started with.
+func (x *exporter) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+
+	s, keep, err := x.server(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !keep {
+		defer s.Disconnect()
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), x.scrapeTimeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	if err := x.collect(ctx, s, &out); err != nil {
+		log.Printf("unable to collect metrics for '%s': %s", target, err)
+
+		out.Reset()
+		writeMetric(&out, "beanstalkd_up", "gauge", "Whether the beanstalk server could be reached", 0)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+// server returns the server for target, connecting on first use, and whether
+// to keep its connection for the next scrape. Only the server beany was
+// started with and configured profiles are kept, so arbitrary targets can't
+// build up connections.
+func (x *exporter) server(target string) (*server, bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if s, ok := x.servers[target]; ok {
+		return s, true, nil
+	}
+
+	opts := x.env.target
+	if target != "" {
+		var err error
+		if opts, err = x.env.config.parseTarget(target); err != nil {
+			return nil, false, err
+		}
+	}
+
+	s := x.env.newServer(append(opts, WithHeartbeat(0))...)
+	if target != "" && !strings.HasPrefix(target, "@") {
+		return s, false, nil
+	}
+	x.servers[target] = s
+	return s, true, nil
+}
+
+func (x *exporter) collect(ctx context.Context, s *server, out *bytes.Buffer) error {
+	if err := s.ensureConnected(ctx); err != nil {
+		return err
+	}
+
+	stats, err := s.Stats(ctx)
+	if err != nil {
+		return err
+	}
+
+	tubes, err := s.ListTubes(ctx)
+	if err != nil {
+		return err
+	}
+
+	tubeStats := map[string]map[string]string{}
+	for _, tube := range tubes {
+		if x.include != nil && !x.include.MatchString(tube) ||
+			x.exclude != nil && x.exclude.MatchString(tube) {
+			continue
+		}
+
+		if tubeStats[tube], err = s.StatsTube(ctx, tube); err != nil {
+			return fmt.Errorf("unable to stats tube '%s': %w", tube, err)
+		}
+	}
+
+	writeMetric(out, "beanstalkd_up", "gauge", "Whether the beanstalk server could be reached", 1)
+
+	for _, key := range sortedMapKeys(stats) {
+		value, ok := metricValue(stats[key])
+		if !ok || infoStats.MatchString(key) {
+			continue
+		}
+
+		name, kind := metricName("beanstalkd_", key)
+		writeMetric(out, name, kind, "beanstalkd stat "+key, value)
+	}
+
+	// Tube metrics are grouped by name, with a sample for each tube
+	samples := map[string][]string{}
+	for tube, stats := range tubeStats {
+		for key, str := range stats {
+			if value, ok := metricValue(str); ok && !infoStats.MatchString(key) {
+				samples[key] = append(samples[key],
+					fmt.Sprintf("{tube=%s} %s", strconv.Quote(tube), formatValue(value)))
+			}
+		}
+	}
+
+	for _, key := range sortedMapKeys(samples) {
+		name, kind := metricName("beanstalkd_tube_", key)
+		fmt.Fprintf(out, "# HELP %s beanstalkd tube stat %s\n# TYPE %s %s\n", name, key, name, kind)
+
+		sort.Strings(samples[key])
+		for _, sample := range samples[key] {
+			fmt.Fprintf(out, "%s%s\n", name, sample)
+		}
+	}
+
+	return nil
+}
+
+// metricName converts a beanstalk stat to a metric name and type.
+func metricName(prefix, key string) (string, string) {
+	if !counterStats.MatchString(key) {
+		return prefix + strings.ReplaceAll(key, "-", "_"), "gauge"
+	}
+
+	key = strings.TrimPrefix(key, "total-")
+	return prefix + strings.ReplaceAll(key, "-", "_") + "_total", "counter"
+}
+
+// metricValue parses a numeric or boolean stat, reporting false for others
+// such as the hostname.
+func metricValue(s string) (float64, bool) {
+	switch s {
+	case "true":
+		return 1, true
+	case "false":
+		return 0, true
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	return value, err == nil
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeMetric(out *bytes.Buffer, name, kind, help string, value float64) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatValue(value))
+}
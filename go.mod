@@ -5,9 +5,16 @@ go 1.21.0
 require (
 	github.com/abiosoft/ishell v2.0.0+incompatible
 	github.com/fatih/color v1.15.0
+	github.com/klauspost/compress v1.17.11
 	github.com/kr/beanstalk v0.0.0-20180818045031-cae1762e4858
 	github.com/nsf/termbox-go v1.1.1
 	github.com/olekukonko/tablewriter v0.0.5
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.21.0
+	google.golang.org/protobuf v1.36.3
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -19,6 +26,6 @@ require (
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	github.com/mattn/go-runewidth v0.0.15 // indirect
 	github.com/rivo/uniseg v0.4.4 // indirect
-	github.com/stretchr/testify v1.5.1 // indirect
-	golang.org/x/sys v0.11.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
 )
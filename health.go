@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
+// startMonitor starts checking the health of the connection in the
+// background, re-establishing it if it drops.
+func (s *server) startMonitor() {
+	s.wake = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	go s.monitor(s.wake, s.stop)
+}
+
+func (s *server) stopMonitor() {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+func (s *server) monitor(wake, stop chan struct{}) {
+	backoff := minReconnectBackoff
+
+	for {
+		var wait <-chan time.Time
+		if s.isStale() {
+			wait = time.After(backoff)
+		} else if heartbeat := s.getHeartbeat(); heartbeat > 0 {
+			wait = time.After(heartbeat)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-wake:
+		case <-wait:
+		}
+
+		if s.isStale() {
+			s.mu.Lock()
+			// The server may have been disconnected, or reconnected by
+			// a command, while waiting for the lock
+			if stopped(stop) || !s.connected.Load() {
+				s.mu.Unlock()
+				return
+			} else if !s.isStale() {
+				s.mu.Unlock()
+				continue
+			}
+			err := s.reset(context.Background())
+			if err == nil {
+				s.setStale(false)
+			}
+			s.mu.Unlock()
+
+			if err != nil {
+				backoff = min(backoff*2, maxReconnectBackoff)
+			} else {
+				backoff = minReconnectBackoff
+			}
+			continue
+		}
+
+		// Skip the heartbeat if a command is using the connection, as that
+		// will find out soon enough whether it's still alive
+		if !s.mu.TryLock() {
+			continue
+		}
+		if stopped(stop) || !s.connected.Load() {
+			s.mu.Unlock()
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s.run(ctx, func() error {
+			_, err := s.bs.Stats()
+			return err
+		})
+		cancel()
+		s.mu.Unlock()
+	}
+}
+
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *server) getHeartbeat() time.Duration {
+	return time.Duration(s.heartbeat.Load())
+}
+
+// setHeartbeat changes how often the connection is checked, waking the
+// monitor so it doesn't wait out the old interval first.
+func (s *server) setHeartbeat(heartbeat time.Duration) {
+	s.heartbeat.Store(int64(heartbeat))
+	s.wakeMonitor()
+}
+
+func (s *server) wakeMonitor() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setStale records whether the connection has dropped, waking the monitor to
+// reconnect and letting the cli update its prompt.
+func (s *server) setStale(stale bool) {
+	if s.stale.Swap(stale) == stale {
+		return
+	}
+
+	if stale {
+		s.wakeMonitor()
+	}
+
+	if s.onChange != nil {
+		go s.onChange()
+	}
+}
+
+// isConnectionError reports whether err means the connection to the server
+// has gone, rather than the server rejecting a command.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var connErr beanstalk.ConnError
+	if errors.As(err, &connErr) {
+		err = connErr.Err
+	}
+
+	var opErr *net.OpError
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.As(err, &opErr)
+}
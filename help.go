@@ -11,6 +11,21 @@ To connect to a beanstalk server on <HOST> using port 11300:
 To connect to a beanstalk server on <HOST> using port <PORT>:
 
   connect <HOST> <PORT>
+  connect <HOST>:<PORT>
+
+IPv6 addresses should be bracketed when a port is given, e.g. [::1]:11300.
+
+To connect to a beanstalk server listening on a unix socket:
+
+  connect unix:///var/run/beanstalkd.sock
+
+To connect and use <TUBE>:
+
+  connect beanstalk://<HOST>:<PORT>/<TUBE>
+
+To connect to the server configured in the profile <NAME>:
+
+  connect @<NAME>
 
 Will error if a connection cannot be established`
 
@@ -18,6 +33,13 @@ Will error if a connection cannot be established`
 
   delete <ID>
 
+Several jobs can be deleted at once, given as ids or ranges of ids, after a
+single confirmation:
+
+  delete <ID|FIRST-LAST> [<ID|FIRST-LAST>...]
+
+With '-', reads the ids from stdin instead, as for kick-job.
+
 This command is available via the 'del' and 'dj' aliases.`
 
 	helpDeleteAll = `Deletes all %s jobs on the current tube.
@@ -38,15 +60,78 @@ specified as an argument:
 
   kick <NUM_JOBS>`
 
+	helpKickJob = `Kicks the buried or delayed jobs with the given ids, or ranges of ids:
+
+  kick-job <JOB_ID|FIRST-LAST> [<JOB_ID|FIRST-LAST>...]
+
+With '-', reads the ids from stdin instead, one or more to a line, until an
+empty line. Lines mentioning jobs as #<JOB_ID>, such as the output of other
+commands, can be pasted in as they are.
+
+This command is available via the 'kj' alias`
+
 	helpListTubes = `List the tubes for the connected beanstalk server. Outputs a table of results,
-display tube, and details of the number of ready, delayed and buried jobs.
+display tube, and details of the number of ready, delayed and buried jobs, and
+how much longer paused tubes are paused for, with a row of totals. Options
+change what's shown:
+
+  --columns ready,reserved,urgent,delayed,buried,watching,waiting,using,paused,total
+  --sort <COLUMN>   sort by a column rather than the tube name
+  --desc            sort in descending order
+  --filter <GLOB>   only show tubes matching the glob
+  --non-empty       only show tubes with jobs
+  --top <N>         only show the first N tubes
+
+Defaults for these can be set in the config, under list_tubes.
 
 This command is available via the 'lt' and 'list' aliases`
 
+	helpMaintenance = `Pauses every tube for maintenance, or restores them afterwards:
+
+  maintenance on
+  maintenance off
+
+Tubes which were already paused are recorded, in ~/.beany_maintenance.json
+unless maintenance_file is set in the config, and paused again for whatever
+time they had left once maintenance is off. Tubes created during maintenance
+aren't paused.`
+
+	helpOpen = `Opens the body of the job with the given id in a viewer:
+
+  open <JOB_ID>
+
+The viewer is the command set for the body's content type under viewers in
+the config, otherwise $VIEWER, otherwise less. The content types are json,
+gzip, zlib, zstd, base64, msgpack, php, text and binary.
+
+Bodies are redacted as for peek, unless --unredacted is given.`
+
+	helpPause = `Pauses a tube, so no jobs can be reserved from it, for the given duration:
+
+  pause <TUBE> <DURATION>
+
+A glob can be given to pause every tube matching it, e.g. 'pause email-* 10m'`
+
 	helpPeekJob = `Looks at the job with the given id.
 
   peek <JOB_ID>
 
+The body is decoded as it's detected to be, or with the decoders given, in
+order, which take the place of any configured for the tube:
+
+  peek --as gzip,json <JOB_ID>
+
+The decoders are gzip, zlib, zstd, base64, json, msgpack, php, hex and text.
+Bodies on tubes configured for protobuf are decoded with its message type and
+shown as JSON, unless decoders are given.
+
+Long bodies are cut short, unless --full is given:
+
+  peek --full <JOB_ID>
+
+Bodies on tubes with redaction rules are redacted, unless --unredacted is
+given and the profile allows it, which is recorded in the audit log.
+
 This command is available via the 'p' alias`
 
 	helpPeek = `Looks at the job at the front of the %s queue.
@@ -55,6 +140,9 @@ A tube argument can also be provided, otherwise uses the current active tube:
 
   peek-%s <TUBE>
 
+The body can be decoded with --as, shown in full with --full, and shown
+unredacted with --unredacted, as for peek.
+
 This command is available via the 'p%c' alias`
 
 	helpPut = `Opens an editor and allows data to be put onto the current tube. Alternatively
@@ -63,14 +151,57 @@ a tube can be provided:
   put <TUBE>
 
 Will first attempt to open an editor defined with the $EDITOR environment
-variable, otherwise defaults to vi.`
+variable, otherwise defaults to vi.
+
+On tubes with a JSON Schema, the job is checked against it before it's put,
+and can be edited again if it doesn't match.
+
+On tubes configured for protobuf, the job is written as JSON or in the
+protobuf text format, and encoded before it's put.`
+
+	helpSave = `Saves the body of the job with the given id to a file, as it is:
+
+  save <JOB_ID> [<FILE>]
+
+Without a file, saves it to job-<JOB_ID> in the current directory, with an
+extension for its content type, e.g. job-123.json. Existing files aren't
+overwritten.
+
+Bodies are redacted as for peek, unless --unredacted is given.`
+
+	helpSaveState = `Saves the bodies of buried, delayed or ready jobs on a tube to a directory,
+one file per job, named as for save:
+
+  save-state <STATE> <TUBE> <DIR> [--limit <N>] [--unredacted]
+
+Saves up to 100 jobs, unless a limit is given. beanstalkd only shows the job
+at the front of each state, so jobs are found by looking through the ids from
+the newest down. At most 100000 ids are looked through, and if that doesn't
+find enough jobs it's reported.`
+
+	helpSet = `Changes a setting for the rest of the session. With no arguments, lists the
+current settings:
+
+  set <SETTING> <VALUE>
+
+Available settings:
+
+  heartbeat  how often to check the connection is alive, or 0 to disable
+  timeout    the longest a command may take, e.g. 3s, or 0 to wait forever`
 
 	helpStats = `Displays statistics for the connected beanstalk server`
 
-	helpStatsJob = `Displays statistics for the specified job:
+	helpStatsJob = `Displays the state of the specified job, its tube and priority, when it was
+created, how long is left of its delay or time to run, what's happened to it,
+and a preview of its body:
 
   stats-job <JOB>
 
+With --watch, keeps refreshing these every second, or every --interval, to
+follow the job until Ctrl-C:
+
+  stats-job --watch [--interval <DURATION>] <JOB>
+
 This command is available via the 'sj' alias`
 
 	helpStatsTube = `Displays stats for the current tube. Alternatively a tube argument can be
@@ -80,11 +211,37 @@ provided:
 
 This command is available via the 'st' alias`
 
+	helpTrack = `Follows jobs, given as ids or ranges of ids as for kick-job, printing what
+happens to them as their stats are polled, until they're deleted or Ctrl-C:
+
+  track <JOB_ID|FIRST-LAST> [<JOB_ID|FIRST-LAST>...] [--interval <DURATION>]
+
+Records changes of state and priority, and each time a job is reserved, times
+out, or is released, buried or kicked. Anything happening more than once
+between polls is shown with a count, e.g. 'released x2'. A timeline of each
+job is printed at the end, and can also be written to a file as JSON with
+--json <FILE>.`
+
+	helpUnpause = `Unpauses a paused tube, or every tube matching a glob:
+
+  unpause <TUBE>`
+
 	helpUse = `Change the current tube in use:
 
   use <TUBE>
 
 This command is available via the 'ut' alias`
 
+	helpValidate = `Checks the ready and buried jobs on the current tube match the JSON Schema
+configured for it, and reports those which don't. Alternatively a tube can be
+provided:
+
+  validate <TUBE> [--limit <N>]
+
+Checks up to 1000 jobs in each state, unless a limit is given. Jobs are found
+as for save-state, and if not every job could be found it's reported. Bodies
+are decoded as for peek before they're checked, so protobuf, compressed,
+msgpack and PHP serialized bodies are checked as the JSON peek shows.`
+
 	helpVersion = `Displays beany version information`
 )
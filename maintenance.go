@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	maintenanceFile = "~/.beany_maintenance.json"
+
+	// maintenancePause is how long tubes are paused for during maintenance,
+	// long enough they stay paused until it's ended
+	maintenancePause = 365 * 24 * time.Hour
+)
+
+// maintenance is the state of a server's tubes from before maintenance
+// started, so it can be restored once it's over.
+type maintenance struct {
+	Started time.Time `json:"started"`
+	Tubes   []string  `json:"tubes"`
+
+	// Paused is the time left for tubes which were already paused
+	Paused map[string]time.Duration `json:"paused,omitempty"`
+}
+
+func loadMaintenance(path string) (map[string]maintenance, error) {
+	state := map[string]maintenance{}
+
+	data, err := os.ReadFile(expandHome(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("unable to parse '%s': %w", path, err)
+	}
+	return state, nil
+}
+
+func saveMaintenance(path string, state map[string]maintenance) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(expandHome(path), append(data, '\n'), 0600)
+}
+
+// startMaintenance pauses every tube on the server, recording which were
+// already paused in the file at path.
+func startMaintenance(ctx context.Context, s *server, path string) (int, error) {
+	if s.readOnly {
+		return 0, errReadOnly
+	}
+
+	connection, err := s.ConnectionStr()
+	if err != nil {
+		return 0, err
+	}
+
+	state, err := loadMaintenance(path)
+	if err != nil {
+		return 0, err
+	}
+	if m, ok := state[connection]; ok {
+		return 0, fmt.Errorf("maintenance already on since %s", m.Started.Format(time.RFC1123))
+	}
+
+	tubes, tubeErrs, err := s.GetTubeStats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for tube, err := range tubeErrs {
+		if !isNotFound(err) {
+			return 0, fmt.Errorf("unable to get stats for tube %s: %w", tube, err)
+		}
+	}
+
+	m := maintenance{
+		Started: time.Now(),
+		Paused:  map[string]time.Duration{},
+	}
+	for _, tube := range sortedMapKeys(tubes) {
+		m.Tubes = append(m.Tubes, tube)
+		if left, _ := strconv.Atoi(tubes[tube]["pause-time-left"]); left > 0 {
+			m.Paused[tube] = time.Duration(left) * time.Second
+		}
+	}
+
+	// Saved first, so the tubes can still be restored if pausing fails part
+	// way through
+	state[connection] = m
+	if err := saveMaintenance(path, state); err != nil {
+		return 0, err
+	}
+
+	for n, tube := range m.Tubes {
+		if err := s.Pause(ctx, tube, maintenancePause); err != nil && !isNotFound(err) {
+			return n, fmt.Errorf("unable to pause tube %s: %w", tube, err)
+		}
+	}
+	return len(m.Tubes), nil
+}
+
+// endMaintenance unpauses the tubes paused by startMaintenance, except those
+// which were already paused, which are paused for whatever time they had
+// left.
+func endMaintenance(ctx context.Context, s *server, path string) (int, error) {
+	if s.readOnly {
+		return 0, errReadOnly
+	}
+
+	connection, err := s.ConnectionStr()
+	if err != nil {
+		return 0, err
+	}
+
+	state, err := loadMaintenance(path)
+	if err != nil {
+		return 0, err
+	}
+	m, ok := state[connection]
+	if !ok {
+		return 0, errors.New("maintenance isn't on")
+	}
+
+	elapsed := time.Since(m.Started)
+	for n, tube := range m.Tubes {
+		left := max(m.Paused[tube]-elapsed, 0)
+		if err := s.Pause(ctx, tube, left); err != nil && !isNotFound(err) {
+			return n, fmt.Errorf("unable to unpause tube %s: %w", tube, err)
+		}
+	}
+
+	delete(state, connection)
+	return len(m.Tubes), saveMaintenance(path, state)
+}
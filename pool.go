@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// maxConns limits the extra connections used to run commands in parallel
+const maxConns = 8
+
+// clone returns a server for a separate connection to the same beanstalk
+// server, which isn't yet connected.
+func (s *server) clone() *server {
+	return &server{
+		host:      s.host,
+		port:      s.port,
+		socket:    s.socket,
+		use:       s.use,
+		transport: s.transport,
+		timeout:   s.timeout,
+		readOnly:  s.readOnly,
+		audit:     s.audit,
+		profile:   s.profile,
+	}
+}
+
+// getConn takes an idle connection from the pool, or makes a new one.
+func (s *server) getConn(ctx context.Context) (*server, error) {
+	s.poolMu.Lock()
+	if n := len(s.idle); n > 0 {
+		conn := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.poolMu.Unlock()
+		return conn, nil
+	}
+	s.poolMu.Unlock()
+
+	conn := s.clone()
+	if err := conn.connect(ctx); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// putConn returns a connection to the pool, unless it has dropped or the pool
+// is full.
+func (s *server) putConn(conn *server) {
+	s.poolMu.Lock()
+	defer s.poolMu.Unlock()
+
+	if conn.isStale() || len(s.idle) >= maxConns {
+		conn.Disconnect()
+		return
+	}
+	s.idle = append(s.idle, conn)
+}
+
+// closePool disconnects the idle connections, as when the server changes.
+func (s *server) closePool() {
+	s.poolMu.Lock()
+	defer s.poolMu.Unlock()
+
+	for _, conn := range s.idle {
+		conn.Disconnect()
+	}
+	s.idle = nil
+}
+
+// parallel runs fn for each of n items in parallel, over connections from the
+// pool, returning the errors in the same order as the items.
+func (s *server) parallel(ctx context.Context, n int, fn func(conn *server, item int) error) []error {
+	errs := make([]error, n)
+	if !s.connected.Load() {
+		for item := range errs {
+			errs[item] = errors.New("not connected to a beanstalk server")
+		}
+		return errs
+	}
+
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for item := 0; item < n; item++ {
+			next <- item
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(n, maxConns); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := s.getConn(ctx)
+			if err == nil {
+				defer s.putConn(conn)
+			}
+
+			for item := range next {
+				if err != nil {
+					errs[item] = err
+				} else {
+					errs[item] = fn(conn, item)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errs
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protobufRule gives the message type of the protobuf encoded bodies of jobs
+// on tubes matching Tube, from a FileDescriptorSet, as written by
+// 'protoc --include_imports --descriptor_set_out'.
+type protobufRule struct {
+	Tube          string `yaml:"tube"`
+	DescriptorSet string `yaml:"descriptor_set"`
+	Message       string `yaml:"message"`
+}
+
+// descriptorSets caches descriptor sets by path, as they're loaded.
+var (
+	descriptorSetsMu sync.Mutex
+	descriptorSets   = map[string]*protoregistry.Files{}
+)
+
+// protobufFor returns the message type configured for the tube's bodies, or
+// nil if they aren't protobuf.
+func (c *config) protobufFor(tube string) (protoreflect.MessageDescriptor, error) {
+	for _, rule := range c.Protobuf {
+		if ok, _ := path.Match(rule.Tube, tube); ok {
+			return rule.messageDescriptor()
+		}
+	}
+	return nil, nil
+}
+
+func (r protobufRule) messageDescriptor() (protoreflect.MessageDescriptor, error) {
+	descriptorSetsMu.Lock()
+	defer descriptorSetsMu.Unlock()
+
+	files, ok := descriptorSets[r.DescriptorSet]
+	if !ok {
+		var err error
+		if files, err = loadDescriptorSet(r.DescriptorSet); err != nil {
+			return nil, err
+		}
+		descriptorSets[r.DescriptorSet] = files
+	}
+
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(r.Message))
+	if err != nil {
+		return nil, fmt.Errorf("no message '%s' in descriptor set '%s'", r.Message, r.DescriptorSet)
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("'%s' in descriptor set '%s' isn't a message", r.Message, r.DescriptorSet)
+	}
+	return md, nil
+}
+
+func loadDescriptorSet(file string) (*protoregistry.Files, error) {
+	data, err := os.ReadFile(expandHome(file))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read descriptor set: %w", err)
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("unable to parse descriptor set '%s': %w", file, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load descriptor set '%s': %w", file, err)
+	}
+	return files, nil
+}
+
+// renderProtobuf renders a protobuf encoded body as JSON, redacted if r isn't
+// nil.
+func renderProtobuf(md protoreflect.MessageDescriptor, body []byte, r *redaction) (string, error) {
+	data, err := protobufJSON(md, body)
+	if err != nil {
+		return "", err
+	}
+	return renderRedacted(decoders["json"], data, r)
+}
+
+// protobufJSON decodes a protobuf encoded body to JSON.
+func protobufJSON(md protoreflect.MessageDescriptor, body []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(body, msg); err != nil {
+		return nil, fmt.Errorf("unable to decode as %s: %w", md.FullName(), err)
+	}
+	return protojson.Marshal(msg)
+}
+
+// encodeProtobuf encodes a message given as JSON or in the protobuf text
+// format.
+func encodeProtobuf(md protoreflect.MessageDescriptor, data []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = protojson.Unmarshal(trimmed, msg)
+	} else {
+		err = prototext.Unmarshal(data, msg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode as %s: %w", md.FullName(), err)
+	}
+
+	return proto.Marshal(msg)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// redacted replaces whatever's redacted from a body.
+const redacted = "[REDACTED]"
+
+// redactRule hides parts of the bodies of jobs on tubes matching Tube, such
+// as emails and card tokens. Fields are paths into structured bodies, e.g.
+// user.email or items.*.card, and Patterns are regular expressions, matched
+// against strings, numbers and keys in structured bodies, or the whole of any
+// other body.
+type redactRule struct {
+	Tube     string   `yaml:"tube"`
+	Fields   []string `yaml:"fields"`
+	Patterns []string `yaml:"patterns"`
+}
+
+// redaction is what's redacted from the bodies of jobs on a tube.
+type redaction struct {
+	fields   [][]string
+	patterns []*regexp.Regexp
+}
+
+// redactionFor returns the redaction for the bodies of jobs on the tube, from
+// every rule matching it, or nil if there's nothing to redact.
+func (c *config) redactionFor(tube string) (*redaction, error) {
+	var r *redaction
+	for _, rule := range c.Redact {
+		if ok, _ := path.Match(rule.Tube, tube); !ok {
+			continue
+		}
+		if r == nil {
+			r = &redaction{}
+		}
+
+		for _, field := range rule.Fields {
+			r.fields = append(r.fields, strings.Split(field, "."))
+		}
+		for _, pattern := range rule.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redaction pattern for tube '%s': %w", rule.Tube, err)
+			}
+			r.patterns = append(r.patterns, re)
+		}
+	}
+	return r, nil
+}
+
+// value redacts a decoded structured body.
+func (r *redaction) value(v interface{}) interface{} {
+	v = jsonValue(v)
+	for _, field := range r.fields {
+		v = redactField(v, field)
+	}
+	return r.strings(v)
+}
+
+func redactField(v interface{}, field []string) interface{} {
+	if len(field) == 0 {
+		return redacted
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if field[0] == "*" || field[0] == k {
+				v[k] = redactField(e, field[1:])
+			}
+		}
+	case []interface{}:
+		for n, e := range v {
+			if field[0] == "*" || field[0] == strconv.Itoa(n) {
+				v[n] = redactField(e, field[1:])
+			}
+		}
+	}
+	return v
+}
+
+// strings redacts the patterns from every string in v, and from numbers and
+// map keys, as card and phone numbers can be stored as either.
+func (r *redaction) strings(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[string(r.bytes([]byte(k)))] = r.strings(e)
+		}
+		return m
+	case []interface{}:
+		for n, e := range v {
+			v[n] = r.strings(e)
+		}
+	case string:
+		return string(r.bytes([]byte(v)))
+	case json.Number:
+		return r.number(string(v), v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return r.number(fmt.Sprint(v), v)
+	}
+	return v
+}
+
+// number redacts the patterns from a number, given as s. Numbers they don't
+// match are left as numbers.
+func (r *redaction) number(s string, v interface{}) interface{} {
+	if redactedNumber := string(r.bytes([]byte(s))); redactedNumber != s {
+		return redactedNumber
+	}
+	return v
+}
+
+// bytes redacts the patterns from an unstructured body.
+func (r *redaction) bytes(body []byte) []byte {
+	for _, re := range r.patterns {
+		body = re.ReplaceAllLiteral(body, []byte(redacted))
+	}
+	return body
+}
+
+// body redacts a body for exporting. Encodings are unwrapped, and structured
+// bodies are exported as JSON.
+func (r *redaction) body(body []byte) []byte {
+	for layer := 0; layer < maxDecodeLayers; layer++ {
+		name, ok := detect(body)
+		if !ok {
+			break
+		}
+
+		d := decoders[name]
+		if d.value != nil {
+			if v, err := d.value(body); err == nil {
+				var data bytes.Buffer
+				enc := json.NewEncoder(&data)
+				enc.SetEscapeHTML(false)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(r.value(v)); err == nil {
+					return data.Bytes()
+				}
+			}
+			break
+		}
+
+		unwrapped, err := d.unwrap(body)
+		if err != nil {
+			break
+		}
+		body = unwrapped
+	}
+	return r.bytes(body)
+}
+
+var errUnredacted = errors.New("unredacted bodies aren't allowed for this server")
+
+// redaction returns the redaction for the bodies of jobs on the tube, or nil
+// if there's nothing to redact. Unredacted bodies are only allowed by profiles
+// permitting them, and what's done with them is recorded in the audit log.
+func (c *cli) redaction(ctx context.Context, tube string, unredacted bool, done string) (*redaction, error) {
+	if len(c.config.Redact) == 0 {
+		return nil, nil
+	}
+
+	if unredacted {
+		if p, err := c.config.profile(c.server.profile); err != nil || !p.AllowUnredacted {
+			return nil, errUnredacted
+		}
+		if err := c.server.record(ctx, done+" unredacted"); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	if tube == "" {
+		return nil, errors.New("unable to find the job's tube to redact it")
+	}
+	return c.config.redactionFor(tube)
+}
+
+// jobTube returns the tube the job is on, if it's needed to decode or redact
+// the job's body.
+func (c *cli) jobTube(ctx context.Context, id uint64) string {
+	if len(c.config.Decoders) == 0 && len(c.config.Protobuf) == 0 && len(c.config.Redact) == 0 {
+		return ""
+	}
+	stats, err := c.server.StatsJob(ctx, id)
+	if err != nil {
+		return ""
+	}
+	return stats["tube"]
+}
+
+// exportBody returns the job's body to save or open, redacted unless
+// unredacted.
+func (c *cli) exportBody(ctx context.Context, id uint64, body []byte, unredacted bool) ([]byte, error) {
+	tube := c.jobTube(ctx, id)
+	r, err := c.redaction(ctx, tube, unredacted, fmt.Sprintf("exported job #%d", id))
+	if err != nil || r == nil {
+		return body, err
+	}
+	return c.config.redactBody(r, tube, body)
+}
+
+// redactBody redacts a body on the tube for exporting, decoding it first if
+// it's protobuf.
+func (c *config) redactBody(r *redaction, tube string, body []byte) ([]byte, error) {
+	md, err := c.protobufFor(tube)
+	if err != nil {
+		return nil, err
+	}
+	if md != nil {
+		if body, err = protobufJSON(md, body); err != nil {
+			return nil, err
+		}
+	}
+	return r.body(body), nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"strconv"
+	"time"
+)
+
+type redriver struct {
+	server      *server
+	tube        string
+	deadLetter  string
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	daemon      bool
+	dryRun      bool
+
+	// seen records when each buried job was first seen buried, after its
+	// latest kick
+	seen map[uint64]sighting
+
+	// unmoved are jobs put on the dead-letter tube which couldn't then be
+	// deleted, with their ids there
+	unmoved map[uint64]uint64
+}
+
+type sighting struct {
+	kicks int
+	at    time.Time
+}
+
+func runRedrive(e env, args []string) error {
+	flags := flag.NewFlagSet("redrive", flag.ExitOnError)
+	tube := flags.String("tube", "*", "Tubes to redrive buried jobs from, as a glob")
+	deadLetter := flags.String("dead-letter", "", "Tube to move jobs to once they've been buried --max-attempts times")
+	maxAttempts := flags.Int("max-attempts", 5, "Times a job can be buried before it's moved to the dead-letter tube")
+	backoff := flags.Duration("backoff", time.Minute, "Delay before kicking a buried job, doubling with each kick, with --daemon only")
+	maxBackoff := flags.Duration("max-backoff", time.Hour, "Longest delay before kicking a buried job, with --daemon only")
+	interval := flags.Duration("interval", 10*time.Second, "How often to check for buried jobs with --daemon")
+	daemon := flags.Bool("daemon", false, "Keep redriving buried jobs")
+	dryRun := flags.Bool("dry-run", false, "Report what would be kicked without kicking anything")
+	flags.Parse(args)
+
+	if *deadLetter == "" {
+		return errors.New("no dead-letter tube given")
+	}
+	if _, err := path.Match(*tube, ""); err != nil {
+		return fmt.Errorf("invalid tube glob: %w", err)
+	}
+	if *maxAttempts < 1 {
+		return errors.New("max-attempts must be at least 1")
+	}
+
+	r := &redriver{
+		server:      e.newServer(append(e.target, WithHeartbeat(0))...),
+		tube:        *tube,
+		deadLetter:  *deadLetter,
+		maxAttempts: *maxAttempts,
+		backoff:     *backoff,
+		maxBackoff:  *maxBackoff,
+		daemon:      *daemon,
+		dryRun:      *dryRun,
+		seen:        map[uint64]sighting{},
+		unmoved:     map[uint64]uint64{},
+	}
+	if r.server.readOnly && !r.dryRun {
+		return errReadOnly
+	}
+
+	for {
+		if err := r.redrive(); err != nil {
+			if !r.daemon {
+				return err
+			}
+			log.Print(err)
+		}
+
+		if !r.daemon {
+			return nil
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// redrive kicks the buried jobs which are due on each tube, and moves those
+// buried too often to the dead-letter tube.
+func (r *redriver) redrive() error {
+	ctx, cancel := r.server.withTimeout(context.Background())
+	defer cancel()
+
+	if err := r.server.ensureConnected(ctx); err != nil {
+		return err
+	}
+
+	tubes, err := r.server.ListTubes(ctx)
+	if err != nil {
+		return err
+	}
+
+	seen := r.seen
+	r.seen = map[uint64]sighting{}
+
+	var kicked, moved int
+	for _, tube := range tubes {
+		if ok, _ := path.Match(r.tube, tube); !ok || tube == r.deadLetter {
+			continue
+		}
+
+		k, m, err := r.redriveTube(ctx, tube, seen)
+		kicked += k
+		moved += m
+		if err != nil {
+			return fmt.Errorf("tube %s: %w", tube, err)
+		}
+	}
+
+	if !r.dryRun && (kicked > 0 || moved > 0 || !r.daemon) {
+		log.Printf("kicked %d buried jobs, moved %d to tube %s", kicked, moved, r.deadLetter)
+	}
+	return nil
+}
+
+// redriveTube kicks or moves each of the tube's buried jobs which are due,
+// skipping those which aren't. beanstalkd only shows the front buried job, so
+// the others are found with jobsInState.
+func (r *redriver) redriveTube(ctx context.Context, tube string, seen map[uint64]sighting) (kicked, moved int, err error) {
+	ids, total, err := r.server.jobsInState(ctx, "buried", tube, math.MaxInt)
+	if isNotFound(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	if err := partialScan(len(ids), total, math.MaxInt, "buried"); err != nil {
+		log.Printf("tube %s: %s", tube, err)
+	}
+
+	for _, id := range ids {
+		// A job put on the dead-letter tube, but not deleted, only needs
+		// deleting
+		if newID, ok := r.unmoved[id]; ok {
+			if err := r.server.Delete(ctx, id); err != nil && !isNotFound(err) {
+				return kicked, moved, err
+			}
+			log.Printf("tube %s: deleted job #%d, already moved to tube %s as #%d", tube, id, r.deadLetter, newID)
+			delete(r.unmoved, id)
+			moved++
+			continue
+		}
+
+		stats, err := r.server.StatsJob(ctx, id)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return kicked, moved, err
+		}
+		if stats["state"] != "buried" {
+			continue
+		}
+		buries, _ := strconv.Atoi(stats["buries"])
+		kicks, _ := strconv.Atoi(stats["kicks"])
+
+		if buries >= r.maxAttempts {
+			if r.dryRun {
+				log.Printf("tube %s: would move job #%d to tube %s, buried %d times", tube, id, r.deadLetter, buries)
+				continue
+			}
+			if err := r.move(ctx, tube, id, stats); err != nil {
+				return kicked, moved, err
+			}
+			moved++
+			continue
+		}
+
+		delay := r.backoff
+		for i := 0; i < kicks && delay < r.maxBackoff; i++ {
+			delay *= 2
+		}
+		delay = min(delay, r.maxBackoff)
+
+		// Backoff is timed from when the job was first seen buried, which
+		// is only known when running as a daemon
+		last, ok := seen[id]
+		if !ok || last.kicks != kicks {
+			last = sighting{kicks: kicks, at: time.Now()}
+		}
+		r.seen[id] = last
+
+		if r.daemon && time.Since(last.at) < delay {
+			continue
+		}
+
+		if r.dryRun {
+			log.Printf("tube %s: would kick job #%d, buried %d times, kicked %d", tube, id, buries, kicks)
+			continue
+		}
+
+		if err := r.server.KickJob(ctx, id); err != nil {
+			return kicked, moved, err
+		}
+		log.Printf("tube %s: kicked job #%d, buried %d times, kicked %d", tube, id, buries, kicks)
+		delete(r.seen, id)
+		kicked++
+	}
+	return kicked, moved, nil
+}
+
+// move puts the job on the dead-letter tube, keeping its priority and time to
+// run, then deletes it. If it can't be deleted it's remembered, so the next
+// pass deletes it rather than moving it again.
+func (r *redriver) move(ctx context.Context, tube string, id uint64, stats map[string]string) error {
+	body, err := r.server.PeekJob(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	pri, _ := strconv.ParseUint(stats["pri"], 10, 32)
+	ttr, _ := strconv.Atoi(stats["ttr"])
+	newID, err := r.server.PutJob(ctx, body, r.deadLetter, uint32(pri), 0, time.Duration(ttr)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	if err := r.server.Delete(ctx, id); err != nil {
+		r.unmoved[id] = newID
+		log.Printf("tube %s: job #%d was put on tube %s as #%d, but couldn't be deleted, so is on both: %s", tube, id, r.deadLetter, newID, err)
+		return err
+	}
+	log.Printf("tube %s: moved job #%d to tube %s as #%d, buried %s times", tube, id, r.deadLetter, newID, stats["buries"])
+	return nil
+}
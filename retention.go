@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type retentionPolicy struct {
+	// Interval is how often to enforce the policy when running as a daemon
+	Interval age             `yaml:"interval"`
+	Rules    []retentionRule `yaml:"rules"`
+}
+
+// retentionRule applies to the buried jobs of tubes matching Tube.
+type retentionRule struct {
+	Tube string `yaml:"tube"`
+
+	// OlderThan deletes buried jobs older than this, archiving them first
+	// if Archive is set
+	OlderThan age    `yaml:"older_than"`
+	Archive   string `yaml:"archive"`
+
+	// MaxBuried deletes the oldest buried jobs beyond this many
+	MaxBuried *int `yaml:"max_buried"`
+}
+
+// age is a duration which may also be given in days, e.g. 14d or 3d12h.
+type age time.Duration
+
+func (a *age) UnmarshalYAML(value *yaml.Node) error {
+	d, err := parseAge(value.Value)
+	if err != nil {
+		return err
+	}
+	*a = age(d)
+	return nil
+}
+
+func (a age) String() string {
+	d := time.Duration(a)
+	if days := d / (24 * time.Hour); days > 0 {
+		if rest := d % (24 * time.Hour); rest > 0 {
+			return fmt.Sprintf("%dd%s", days, rest)
+		}
+		return fmt.Sprintf("%dd", days)
+	}
+	return d.String()
+}
+
+func parseAge(s string) (time.Duration, error) {
+	days, rest, ok := strings.Cut(s, "d")
+	if !ok {
+		return time.ParseDuration(s)
+	}
+
+	n, err := strconv.Atoi(days)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse age '%s'", s)
+	}
+	d := time.Duration(n) * 24 * time.Hour
+
+	if rest != "" {
+		r, err := time.ParseDuration(rest)
+		if err != nil {
+			return 0, fmt.Errorf("unable to parse age '%s'", s)
+		}
+		d += r
+	}
+	return d, nil
+}
+
+type retention struct {
+	server *server
+	dryRun bool
+}
+
+func runRetention(e env, args []string) error {
+	flags := flag.NewFlagSet("retention", flag.ExitOnError)
+	policyPath := flags.String("config", "policy.yaml", "Retention policy to enforce")
+	daemon := flags.Bool("daemon", false, "Keep enforcing the policy at its interval")
+	dryRun := flags.Bool("dry-run", false, "Report what would be deleted without deleting anything")
+	flags.Parse(args)
+
+	policy, err := loadRetentionPolicy(*policyPath)
+	if err != nil {
+		return err
+	}
+
+	r := retention{
+		server: e.newServer(append(e.target, WithHeartbeat(0))...),
+		dryRun: *dryRun,
+	}
+	if r.server.readOnly && !r.dryRun {
+		return errReadOnly
+	}
+
+	for {
+		if err := r.enforce(policy); err != nil {
+			if !*daemon {
+				return err
+			}
+			log.Print(err)
+		}
+
+		if !*daemon {
+			return nil
+		}
+		time.Sleep(time.Duration(policy.Interval))
+	}
+}
+
+func loadRetentionPolicy(policyPath string) (*retentionPolicy, error) {
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &retentionPolicy{Interval: age(time.Hour)}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("unable to parse '%s': %w", policyPath, err)
+	}
+
+	if policy.Interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+	for i, rule := range policy.Rules {
+		if rule.Tube == "" {
+			policy.Rules[i].Tube = "*"
+		} else if _, err := path.Match(rule.Tube, ""); err != nil {
+			return nil, fmt.Errorf("rule %d has an invalid tube glob: %w", i+1, err)
+		}
+		if rule.OlderThan <= 0 && rule.MaxBuried == nil {
+			return nil, fmt.Errorf("rule %d needs older_than or max_buried", i+1)
+		}
+		if rule.Archive != "" && rule.OlderThan <= 0 {
+			return nil, fmt.Errorf("rule %d archives jobs, but has no older_than", i+1)
+		}
+	}
+
+	return policy, nil
+}
+
+// enforce applies each rule to the tubes it matches.
+func (r retention) enforce(policy *retentionPolicy) error {
+	ctx, cancel := r.server.withTimeout(context.Background())
+	defer cancel()
+
+	if err := r.server.ensureConnected(ctx); err != nil {
+		return err
+	}
+
+	tubes, err := r.server.ListTubes(ctx)
+	if err != nil {
+		return err
+	}
+
+	var deleted int
+	var atLeast string
+	for _, rule := range policy.Rules {
+		for _, tube := range tubes {
+			if ok, _ := path.Match(rule.Tube, tube); !ok {
+				continue
+			}
+
+			n, err := r.apply(ctx, rule, tube)
+			deleted += n
+			if err != nil {
+				return fmt.Errorf("tube %s: %w", tube, err)
+			}
+			if n > 0 && rule.OlderThan > 0 {
+				atLeast = "at least "
+			}
+		}
+	}
+
+	if r.dryRun {
+		log.Printf("would delete %s%d buried jobs", atLeast, deleted)
+	} else {
+		log.Printf("deleted %d buried jobs", deleted)
+	}
+	return nil
+}
+
+// apply deletes buried jobs from the front of the tube's buried queue, which
+// is in the order they were buried. beanstalkd only shows the front job, so
+// this stops at the first job the rule keeps.
+func (r retention) apply(ctx context.Context, rule retentionRule, tube string) (int, error) {
+	stats, err := r.server.StatsTube(ctx, tube)
+	if err != nil {
+		return 0, err
+	}
+	buried, _ := strconv.Atoi(stats["current-jobs-buried"])
+
+	var deleted int
+	for buried > 0 {
+		id, body, err := r.server.Peek(ctx, "buried", tube)
+		if isNotFound(err) {
+			return deleted, nil
+		} else if err != nil {
+			return deleted, err
+		}
+
+		jobStats, err := r.server.StatsJob(ctx, id)
+		if err != nil {
+			return deleted, err
+		}
+		ageSecs, _ := strconv.Atoi(jobStats["age"])
+		jobAge := age(time.Duration(ageSecs) * time.Second)
+
+		var reason string
+		if rule.MaxBuried != nil && buried > *rule.MaxBuried {
+			reason = fmt.Sprintf("%d buried, over the cap of %d", buried, *rule.MaxBuried)
+		} else if rule.OlderThan > 0 && jobAge > rule.OlderThan {
+			reason = fmt.Sprintf("older than %s", rule.OlderThan)
+		} else {
+			return deleted, nil
+		}
+
+		archive := rule.Archive != "" && rule.OlderThan > 0 && jobAge > rule.OlderThan
+		action := "deleted"
+		if archive {
+			action = "archived and deleted"
+		}
+
+		// A dry run can't delete jobs to see past the front one, so it counts
+		// those over the cap, and at least the front job if it's too old
+		if r.dryRun {
+			n, atLeast := 1, ""
+			if rule.MaxBuried != nil && buried > *rule.MaxBuried {
+				n = buried - *rule.MaxBuried
+			}
+			if rule.OlderThan > 0 && n < buried {
+				atLeast = "at least "
+			}
+			log.Printf("tube %s: would delete %s%d of %d buried jobs, from #%d (%s old, %s)",
+				tube, atLeast, n, buried, id, jobAge, reason)
+			return n, nil
+		}
+
+		if archive {
+			if err := archiveJob(strings.ReplaceAll(rule.Archive, "{tube}", tube), id, body, jobStats); err != nil {
+				return deleted, err
+			}
+		}
+
+		if err := r.server.Delete(ctx, id); err != nil {
+			return deleted, err
+		}
+		log.Printf("tube %s: %s buried job #%d, %s old, %s", tube, action, id, jobAge, reason)
+
+		deleted++
+		buried--
+	}
+
+	return deleted, nil
+}
+
+// archiveJob appends the job as a line of JSON to the file at path.
+func archiveJob(path string, id uint64, body []byte, stats map[string]string) error {
+	record := jobJSON(id, body, stats)
+	record["archived_at"] = time.Now().UTC().Format(time.RFC3339)
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(expandHome(path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to archive job: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("unable to archive job: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// scanBatch is how many job ids are looked at together, when finding
+	// jobs in a state
+	scanBatch = 256
+
+	// maxJobScan is the most job ids looked at, when finding jobs in a state
+	maxJobScan = 100000
+)
+
+// bodyExtensions are the file extensions for bodies of each content type.
+var bodyExtensions = map[string]string{
+	"base64":  ".b64",
+	"binary":  ".bin",
+	"gzip":    ".gz",
+	"json":    ".json",
+	"msgpack": ".msgpack",
+	"php":     ".txt",
+	"text":    ".txt",
+	"zlib":    ".zlib",
+	"zstd":    ".zst",
+}
+
+// contentType names the format of a body as it's detected for decoding, or
+// as text or binary.
+func contentType(body []byte) string {
+	if name, ok := detect(body); ok {
+		return name
+	} else if isText(body) {
+		return "text"
+	}
+	return "binary"
+}
+
+// writeBody writes a job's body to the file, which mustn't already exist.
+func writeBody(file string, body []byte) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// launch runs a command, such as an editor, on the file, attached to the
+// terminal.
+func launch(command, file string) error {
+	args := append(strings.Fields(command), file)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// viewer returns the command to open bodies of the content type with.
+func (c *cli) viewer(contentType string) string {
+	if viewer := c.config.Viewers[contentType]; viewer != "" {
+		return viewer
+	} else if viewer := os.Getenv("VIEWER"); viewer != "" {
+		return viewer
+	}
+	return "less"
+}
+
+// jobsInState finds up to limit of the jobs in the state on the tube, in
+// order of id, and returns how many there are. beanstalkd only shows the job
+// at the front of each state, which needn't have the lowest id, so jobs are
+// found by looking through the ids from the newest down. This stops once
+// enough are found, or after maxJobScan ids, so on servers which have seen
+// many jobs fewer may be found than there are.
+func (s *server) jobsInState(ctx context.Context, state, tube string, limit int) ([]uint64, int, error) {
+	tubeStats, err := s.StatsTube(ctx, tube)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, _ := strconv.Atoi(tubeStats["current-jobs-"+state])
+	want := min(limit, total)
+	if want == 0 {
+		return nil, total, nil
+	}
+
+	stats, err := s.Stats(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	newest, err := strconv.ParseUint(stats["total-jobs"], 10, 64)
+	if err != nil {
+		return nil, 0, errors.New("unable to find the newest job")
+	}
+
+	var ids []uint64
+	for to, scanned := newest, uint64(0); len(ids) < want && to > 0 && scanned < maxJobScan; {
+		n := min(scanBatch, to, maxJobScan-scanned)
+		from := to - n + 1
+
+		matches := make([]bool, n)
+		errs := s.parallel(ctx, int(n), func(conn *server, item int) error {
+			stats, err := conn.StatsJob(ctx, from+uint64(item))
+			matches[item] = err == nil && stats["tube"] == tube && stats["state"] == state
+			if isNotFound(err) {
+				return nil
+			}
+			return err
+		})
+		for _, err := range errs {
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+
+		for item := int(n) - 1; item >= 0; item-- {
+			if matches[item] && len(ids) < want {
+				ids = append(ids, from+uint64(item))
+			}
+		}
+		to -= n
+		scanned += n
+	}
+
+	slices.Sort(ids)
+	return ids, total, nil
+}
+
+// partialScan reports finding fewer of the jobs in a state than asked for, as
+// jobsInState gave up looking.
+func partialScan(found, total, limit int, state string) error {
+	if found >= min(limit, total) {
+		return nil
+	}
+	return fmt.Errorf("only found %d of the %d %s jobs, looking through the newest %d job ids", found, total, state, maxJobScan)
+}
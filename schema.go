@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaRule gives the JSON Schema the bodies of jobs on tubes matching Tube
+// should conform to.
+type schemaRule struct {
+	Tube   string `yaml:"tube"`
+	Schema string `yaml:"schema"`
+}
+
+// schemas caches compiled schemas by path, as they're loaded.
+var (
+	schemasMu sync.Mutex
+	schemas   = map[string]*jsonschema.Schema{}
+)
+
+// schemaFor returns the schema for the bodies of jobs on the tube, or nil if
+// there isn't one.
+func (c *config) schemaFor(tube string) (*jsonschema.Schema, error) {
+	for _, rule := range c.Schemas {
+		if ok, _ := path.Match(rule.Tube, tube); !ok {
+			continue
+		}
+
+		schemasMu.Lock()
+		defer schemasMu.Unlock()
+
+		file := expandHome(rule.Schema)
+		if schema, ok := schemas[file]; ok {
+			return schema, nil
+		}
+		schema, err := jsonschema.Compile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load schema for tube '%s': %w", rule.Tube, err)
+		}
+		schemas[file] = schema
+		return schema, nil
+	}
+	return nil, nil
+}
+
+// schemaJSON returns a body on the tube as the JSON its schema describes.
+// Protobuf is decoded, encodings such as gzip and base64 unwrapped, and
+// msgpack and PHP serialized bodies converted, as peek does.
+func (c *config) schemaJSON(tube string, body []byte) ([]byte, error) {
+	md, err := c.protobufFor(tube)
+	if err != nil {
+		return nil, err
+	}
+	if md != nil {
+		return protobufJSON(md, body)
+	}
+
+	names := c.decodersFor(tube)
+	for layer := 0; layer < maxDecodeLayers+len(names); layer++ {
+		var name string
+		if layer < len(names) {
+			name = names[layer]
+		} else if name, _ = detect(body); name == "" {
+			break
+		}
+
+		d, ok := decoders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown decoder '%s'", name)
+		}
+		switch {
+		case name == "json" || d.render != nil && d.value == nil:
+			return body, nil
+		case d.value != nil:
+			v, err := d.value(body)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode as %s: %w", name, err)
+			}
+			return json.MarshalIndent(jsonValue(v), "", "  ")
+		}
+
+		if body, err = d.unwrap(body); err != nil {
+			return nil, fmt.Errorf("unable to decode as %s: %w", name, err)
+		}
+	}
+	return body, nil
+}
+
+// schemaError is where a body doesn't conform to its schema.
+type schemaError struct {
+	// line and column are 0 if the body couldn't be decoded
+	line, column int
+
+	// at is the JSON pointer to the value in error, if any
+	at      string
+	message string
+}
+
+func (e schemaError) Error() string {
+	if e.line == 0 {
+		return e.message
+	} else if e.at == "" {
+		return fmt.Sprintf("line %d, column %d: %s", e.line, e.column, e.message)
+	}
+	return fmt.Sprintf("line %d, column %d: %s: %s", e.line, e.column, e.at, e.message)
+}
+
+// validateJob returns where a job's body on the tube doesn't conform to the
+// schema, once it's decoded as for schemaJSON.
+func (c *config) validateJob(schema *jsonschema.Schema, tube string, body []byte) []schemaError {
+	data, err := c.schemaJSON(tube, body)
+	if err != nil {
+		return []schemaError{{message: err.Error()}}
+	}
+	return validateBody(schema, data)
+}
+
+// validateBody returns where the body doesn't conform to the schema.
+func validateBody(schema *jsonschema.Schema, body []byte) []schemaError {
+	v, err := decodeJSON(body)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		offset := len(body)
+		if errors.As(err, &syntaxErr) {
+			// The offset is just after the invalid character
+			offset = max(int(syntaxErr.Offset)-1, 0)
+		}
+		line, column := position(body, offset)
+		return []schemaError{{line: line, column: column, message: "invalid JSON: " + err.Error()}}
+	}
+
+	err = schema.Validate(v)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return nil
+	}
+
+	var errs []schemaError
+	for _, cause := range leafCauses(validationErr) {
+		offset, _ := valueOffset(body, cause.InstanceLocation)
+		line, column := position(body, offset)
+		errs = append(errs, schemaError{line: line, column: column, at: cause.InstanceLocation, message: cause.Message})
+	}
+	return errs
+}
+
+// leafCauses returns the validation errors which have no further causes, as
+// those describe what's actually wrong.
+func leafCauses(err *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(err.Causes) == 0 {
+		return []*jsonschema.ValidationError{err}
+	}
+
+	var leaves []*jsonschema.ValidationError
+	for _, cause := range err.Causes {
+		leaves = append(leaves, leafCauses(cause)...)
+	}
+	return leaves
+}
+
+// valueOffset returns the offset in data of the value at the JSON pointer.
+func valueOffset(data []byte, pointer string) (int, bool) {
+	var keys []string
+	if pointer != "" {
+		for _, key := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+			keys = append(keys, strings.NewReplacer("~1", "/", "~0", "~").Replace(key))
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		if len(keys) == 0 {
+			return skipSeparators(data, int(dec.InputOffset())), true
+		}
+
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, false
+		}
+
+		found := false
+		switch tok {
+		case json.Delim('{'):
+			for !found && dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return 0, false
+				}
+				if found = key == keys[0]; !found && skipValue(dec) != nil {
+					return 0, false
+				}
+			}
+		case json.Delim('['):
+			for n := 0; !found && dec.More(); n++ {
+				if found = strconv.Itoa(n) == keys[0]; !found && skipValue(dec) != nil {
+					return 0, false
+				}
+			}
+		}
+		if !found {
+			return 0, false
+		}
+		keys = keys[1:]
+	}
+}
+
+func skipValue(dec *json.Decoder) error {
+	var raw json.RawMessage
+	return dec.Decode(&raw)
+}
+
+// skipSeparators skips whitespace, and the colons and commas between values.
+func skipSeparators(data []byte, offset int) int {
+	for offset < len(data) && strings.IndexByte(" \t\r\n:,", data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// position returns the line and column of the offset in data, from 1.
+func position(data []byte, offset int) (line, column int) {
+	offset = min(offset, len(data))
+	line = 1 + bytes.Count(data[:offset], []byte("\n"))
+	return line, offset - bytes.LastIndexByte(data[:offset], '\n')
+}
@@ -1,20 +1,58 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kr/beanstalk"
 )
 
 type server struct {
+	mu        sync.Mutex // guards use of the connection
 	bs        *beanstalk.Conn
-	connected bool
+	conn      net.Conn
+	connected atomic.Bool
 	host      string
 	port      int
+	socket    string
+	use       string
+	transport transport
+	timeout   time.Duration
+	readOnly  bool
+	audit     *auditLog
+
+	// profile is the name of the config profile connected to, if any
+	profile string
+
+	// defaultTransport is used by servers which don't configure their own
+	defaultTransport transport
+
+	// defaultReadOnly is set when every server should be read-only
+	defaultReadOnly bool
+
+	// idle are connections kept for running commands in parallel
+	poolMu sync.Mutex
+	idle   []*server
+
+	// heartbeat is how often the monitor checks the connection, as a
+	// time.Duration, and can be changed while it runs
+	heartbeat atomic.Int64
+
+	// stale is set when the connection has dropped and is being re-established
+	stale    atomic.Bool
+	onChange func()
+	wake     chan struct{}
+	stop     chan struct{}
 }
 
 type serverOption func(s *server)
@@ -31,7 +69,70 @@ func WithPort(port int) serverOption {
 	}
 }
 
-func (s *server) connect() (err error) {
+func WithSocket(path string) serverOption {
+	return func(s *server) {
+		s.socket = path
+	}
+}
+
+func WithTransport(t transport) serverOption {
+	return func(s *server) {
+		s.transport = t
+	}
+}
+
+func WithDefaultTransport(t transport) serverOption {
+	return func(s *server) {
+		s.defaultTransport = t
+		s.transport = t
+	}
+}
+
+func WithReadOnly(readOnly bool) serverOption {
+	return func(s *server) {
+		s.readOnly = s.readOnly || readOnly
+	}
+}
+
+func WithProfile(name string) serverOption {
+	return func(s *server) {
+		s.profile = name
+	}
+}
+
+func WithDefaultReadOnly(readOnly bool) serverOption {
+	return func(s *server) {
+		s.defaultReadOnly = readOnly
+		s.readOnly = readOnly
+	}
+}
+
+func WithAuditLog(audit *auditLog) serverOption {
+	return func(s *server) {
+		s.audit = audit
+	}
+}
+
+// WithTube selects the tube to use once connected.
+func WithTube(tube string) serverOption {
+	return func(s *server) {
+		s.use = tube
+	}
+}
+
+func WithTimeout(timeout time.Duration) serverOption {
+	return func(s *server) {
+		s.timeout = timeout
+	}
+}
+
+func WithHeartbeat(heartbeat time.Duration) serverOption {
+	return func(s *server) {
+		s.heartbeat.Store(int64(heartbeat))
+	}
+}
+
+func (s *server) connect(ctx context.Context) (err error) {
 	if s.host == "" {
 		s.host = "127.0.0.1"
 	}
@@ -40,31 +141,268 @@ func (s *server) connect() (err error) {
 		s.port = 11300
 	}
 
+	c, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	if s.connected.Load() {
+		s.stopMonitor()
+		s.closePool()
+		s.bs.Close()
+	}
+
+	s.conn = c
+	s.bs = beanstalk.NewConn(c)
+	if s.use != "" {
+		s.bs.Tube.Name = s.use
+	}
+	s.connected.Store(true)
+	s.stale.Store(false)
+	s.startMonitor()
+
+	return
+}
+
+func (s *server) dial(ctx context.Context) (net.Conn, error) {
+	if s.socket != "" {
+		return s.transport.dial(ctx, "unix", s.socket)
+	}
+
 	address := net.JoinHostPort(s.host, strconv.Itoa(s.port))
+	return s.transport.dial(ctx, "tcp", address)
+}
 
-	c, err := net.DialTimeout("tcp", address, time.Second*5)
+// reset replaces the connection with a fresh one, keeping the tube in use and
+// the watch list. It's needed after an interrupted command, as the old
+// connection may still have a response in flight which would be read by the
+// next command, and after the connection has dropped.
+func (s *server) reset(ctx context.Context) error {
+	c, err := s.dial(ctx)
 	if err != nil {
 		return err
 	}
+
+	old := s.bs
+	old.Close()
+
+	s.conn = c
 	s.bs = beanstalk.NewConn(c)
-	s.connected = true
+	s.bs.Tube.Name = old.Tube.Name
 
-	return
+	var watched []string
+	for name := range old.TubeSet.Name {
+		watched = append(watched, name)
+	}
+	s.bs.TubeSet = *beanstalk.NewTubeSet(s.bs, watched...)
+
+	return nil
+}
+
+// do runs fn against the connection, giving up when ctx is done.
+func (s *server) do(ctx context.Context, fn func() error) error {
+	if !s.connected.Load() {
+		return errors.New("not connected to a beanstalk server")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.run(ctx, fn)
+}
+
+// run is do for callers already holding s.mu.
+func (s *server) run(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.stale.Load() {
+		if err := s.reset(ctx); err != nil {
+			return fmt.Errorf("connection to beanstalk server lost, reconnecting: %w", err)
+		}
+		s.setStale(false)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+		defer s.conn.SetDeadline(time.Time{})
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// Unblock any pending read or write
+			s.conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	err := fn()
+	close(stop)
+	<-stopped
+
+	var netErr net.Error
+	if err != nil && (ctx.Err() != nil || errors.As(err, &netErr) && netErr.Timeout()) {
+		if resetErr := s.reset(context.Background()); resetErr != nil {
+			s.setStale(true)
+			return fmt.Errorf("unable to reconnect after interrupted command: %w", resetErr)
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return context.DeadlineExceeded
+	}
+
+	if isConnectionError(err) {
+		s.setStale(true)
+		return fmt.Errorf("lost connection to beanstalk server: %w", err)
+	}
+
+	return err
+}
+
+// withTimeout bounds ctx by the configured per-command timeout, if any.
+func (s *server) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout > 0 {
+		return context.WithTimeout(ctx, s.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+var errReadOnly = errors.New("not allowed, connected in read-only mode")
+
+// change runs fn like do, for commands which change the server. These are
+// refused in read-only mode, and recorded in the audit log once done.
+func (s *server) change(ctx context.Context, fn func() error, describe func() string) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+
+	if err := s.do(ctx, fn); err != nil {
+		return err
+	}
+
+	// The change has been made, so failing to record it is warned of rather
+	// than returned, which would report the change as failed
+	if err := s.record(ctx, describe()); err != nil {
+		log.Printf("warning: %s", err)
+	}
+	return nil
+}
+
+// isNotFound reports whether err is the server not finding a job or tube.
+func isNotFound(err error) bool {
+	var connErr beanstalk.ConnError
+	return errors.As(err, &connErr) && connErr.Err == beanstalk.ErrNotFound
+}
+
+func (s *server) record(ctx context.Context, change string) error {
+	connection, _ := s.ConnectionStr()
+	return s.audit.record(ctx, connection, "%s", change)
+}
+
+// tube returns a handle on the named tube for the current connection. It must
+// be called within do, as reconnecting replaces the connection.
+func (s *server) tube(name string) *beanstalk.Tube {
+	return &beanstalk.Tube{
+		Conn: s.bs,
+		Name: name,
+	}
+}
+
+// command sends a command the beanstalk client doesn't support, expecting
+// reply from the server. Like tube, it must be called within do, so no other command
+// is waiting on a reply.
+func (s *server) command(reply string, op string, args ...interface{}) error {
+	line := op
+	for _, arg := range args {
+		line += fmt.Sprint(" ", arg)
+	}
+
+	if _, err := io.WriteString(s.conn, line+"\r\n"); err != nil {
+		return beanstalk.ConnError{Conn: s.bs, Op: op, Err: err}
+	}
+
+	// Read byte by byte, so nothing is left buffered for the next command
+	var resp []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(resp, []byte("\r\n")) {
+		if _, err := io.ReadFull(s.conn, b); err != nil {
+			return beanstalk.ConnError{Conn: s.bs, Op: op, Err: err}
+		}
+		resp = append(resp, b[0])
+	}
+
+	switch got := string(resp[:len(resp)-2]); got {
+	case reply:
+		return nil
+	case "NOT_FOUND":
+		return beanstalk.ConnError{Conn: s.bs, Op: op, Err: beanstalk.ErrNotFound}
+	default:
+		return beanstalk.ConnError{Conn: s.bs, Op: op, Err: errors.New(strings.ToLower(got))}
+	}
 }
 
-func (s *server) Bury(toBury uint64) error {
-	return s.bs.Bury(toBury, 1)
+func (s *server) Bury(ctx context.Context, toBury uint64) error {
+	return s.BuryJob(ctx, toBury, 1)
 }
 
-func (s *server) Connect(host string, port int) error {
-	s.host = host
-	s.port = port
-	return s.connect()
+// BuryJob buries a reserved job with the given priority.
+func (s *server) BuryJob(ctx context.Context, toBury uint64, pri uint32) error {
+	return s.change(ctx, func() error {
+		return s.bs.Bury(toBury, pri)
+	}, func() string {
+		return fmt.Sprintf("buried job #%d", toBury)
+	})
+}
+
+// Connect connects to the server described by opts, replacing any previous
+// connection.
+func (s *server) Connect(ctx context.Context, opts ...serverOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	host, port, socket, use, transport, readOnly, profile := s.host, s.port, s.socket, s.use, s.transport, s.readOnly, s.profile
+
+	s.host = ""
+	s.port = 0
+	s.socket = ""
+	s.use = ""
+	s.transport = s.defaultTransport
+	s.readOnly = s.defaultReadOnly
+	s.profile = ""
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := s.connect(ctx); err != nil {
+		s.host, s.port, s.socket, s.use, s.transport, s.readOnly, s.profile = host, port, socket, use, transport, readOnly, profile
+		return err
+	}
+	return nil
+}
+
+// ensureConnected connects to the server if not already connected.
+func (s *server) ensureConnected(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.connected.Load() {
+		return nil
+	}
+	return s.connect(ctx)
 }
 
 func (s *server) ConnectionStr() (string, error) {
-	if s.connected {
-		return fmt.Sprintf("%v:%v", s.host, s.port), nil
+	if s.connected.Load() && s.socket != "" {
+		return "unix://" + s.socket, nil
+	} else if s.connected.Load() {
+		return net.JoinHostPort(s.host, strconv.Itoa(s.port)), nil
 	}
 
 	return "", errors.New("not connected to a beanstalk server")
@@ -75,44 +413,47 @@ func (s *server) CurrentTube() *beanstalk.Tube {
 }
 
 func (s *server) CurrentTubeName() (string, error) {
-	if !s.connected {
+	if !s.connected.Load() {
 		return "", errors.New("can't determine current tube, not connected to a beanstalk server")
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	currentTube := s.CurrentTube()
 	return currentTube.Name, nil
 }
 
-func (s *server) Delete(toDelete uint64) error {
-	return s.bs.Delete(toDelete)
+func (s *server) Delete(ctx context.Context, toDelete uint64) error {
+	return s.change(ctx, func() error {
+		return s.bs.Delete(toDelete)
+	}, func() string {
+		return fmt.Sprintf("deleted job #%d", toDelete)
+	})
 }
 
-func (s *server) DeleteAll(state, name string) (int, error) {
-	tube := beanstalk.Tube{
-		Conn: s.bs,
-		Name: name,
+func (s *server) DeleteAll(ctx context.Context, state, name string) (n int, err error) {
+	if s.readOnly {
+		return 0, errReadOnly
 	}
 
-	var (
-		err error
-		id  uint64
-		n   int
-	)
+	defer func() {
+		if n > 0 {
+			if err := s.record(ctx, fmt.Sprintf("deleted %d %s jobs from tube %s", n, state, name)); err != nil {
+				log.Printf("warning: %s", err)
+			}
+		}
+	}()
 
 	for {
-		switch state {
-		case "ready":
-			id, _, err = tube.PeekReady()
-		case "buried":
-			id, _, err = tube.PeekBuried()
-		case "delayed":
-			id, _, err = tube.PeekDelayed()
-		}
+		id, _, err := s.Peek(ctx, state, name)
 		if err != nil {
 			return n, err
 		}
 
-		if err := s.Delete(id); err != nil {
+		if err := s.do(ctx, func() error {
+			return s.bs.Delete(id)
+		}); err != nil {
 			return n, err
 		}
 
@@ -121,139 +462,256 @@ func (s *server) DeleteAll(state, name string) (int, error) {
 }
 
 func (s *server) Disconnect() error {
-	if !s.connected {
+	if !s.connected.Load() {
 		return errors.New("can't disconnect, not connected to a beanstalk server")
 	}
 
-	s.connected = false
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopMonitor()
+	s.closePool()
+	s.connected.Store(false)
+	s.stale.Store(false)
 	return s.bs.Close()
 }
 
-func (s *server) GetTubeStats() (map[string]map[string]string, error) {
-	if !s.connected {
-		return nil, errors.New("can't get tube stats, not connected to a beanstalk server")
+// GetTubeStats returns the stats of every tube, fetched in parallel. Tubes
+// whose stats can't be fetched, such as those which have gone since being
+// listed, are left out, with their errors returned in tubeErrs.
+func (s *server) GetTubeStats(ctx context.Context) (tubeStats map[string]map[string]string, tubeErrs map[string]error, err error) {
+	if !s.connected.Load() {
+		return nil, nil, errors.New("can't get tube stats, not connected to a beanstalk server")
 	}
 
-	tubes, err := s.ListTubes()
+	tubes, err := s.ListTubes(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	tubeStats := map[string]map[string]string{}
-	for _, tube := range tubes {
-		stats, _ := s.StatsTube(tube)
-		tubeStats[tube] = stats
+	stats := make([]map[string]string, len(tubes))
+	errs := s.parallel(ctx, len(tubes), func(conn *server, n int) (err error) {
+		stats[n], err = conn.StatsTube(ctx, tubes[n])
+		return
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
 	}
-	return tubeStats, nil
+
+	tubeStats = map[string]map[string]string{}
+	tubeErrs = map[string]error{}
+	for n, tube := range tubes {
+		if errs[n] != nil {
+			tubeErrs[tube] = errs[n]
+		} else {
+			tubeStats[tube] = stats[n]
+		}
+	}
+	return tubeStats, tubeErrs, nil
 }
 
 func (s *server) isConnected() bool {
-	return s.connected
+	return s.connected.Load()
+}
+
+func (s *server) isStale() bool {
+	return s.stale.Load()
 }
 
-func (s *server) Kick(name string, toKick int) (int, error) {
-	if !s.connected {
+func (s *server) Kick(ctx context.Context, name string, toKick int) (int, error) {
+	if !s.connected.Load() {
 		return 0, errors.New("can't kick, not connected to a beanstalk server")
 	}
 
-	tube := beanstalk.Tube{
-		Conn: s.bs,
-		Name: name,
+	var kicked int
+	err := s.change(ctx, func() (err error) {
+		kicked, err = s.tube(name).Kick(toKick)
+		return
+	}, func() string {
+		return fmt.Sprintf("kicked %d jobs on tube %s", kicked, name)
+	})
+	return kicked, err
+}
+
+// KickJob kicks a single buried or delayed job, so it's ready to be reserved.
+func (s *server) KickJob(ctx context.Context, id uint64) error {
+	if !s.connected.Load() {
+		return errors.New("can't kick, not connected to a beanstalk server")
 	}
-	return tube.Kick(toKick)
+
+	return s.change(ctx, func() error {
+		return s.command("KICKED", "kick-job", id)
+	}, func() string {
+		return fmt.Sprintf("kicked job #%d", id)
+	})
 }
 
-func (s *server) ListTubes() ([]string, error) {
-	if !s.connected {
+func (s *server) ListTubes(ctx context.Context) ([]string, error) {
+	if !s.connected.Load() {
 		return nil, errors.New("can't list tubes, not connected to a beanstalk server")
 	}
 
-	tubes, err := s.bs.ListTubes()
+	var tubes []string
+	err := s.do(ctx, func() (err error) {
+		tubes, err = s.bs.ListTubes()
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
 	return tubes, nil
 }
 
-func (s *server) Peek(state, name string) (uint64, []byte, error) {
-	if !s.connected {
-		return 0, nil, errors.New("can't peek, not connected to a beanstalk server")
+// Pause stops jobs being reserved from the tube for d, or unpauses it when d
+// is 0.
+func (s *server) Pause(ctx context.Context, name string, d time.Duration) error {
+	if !s.connected.Load() {
+		return errors.New("can't pause, not connected to a beanstalk server")
 	}
 
-	tube := beanstalk.Tube{
-		Conn: s.bs,
-		Name: name,
+	return s.change(ctx, func() error {
+		return s.tube(name).Pause(d)
+	}, func() string {
+		if d == 0 {
+			return fmt.Sprintf("unpaused tube %s", name)
+		}
+		return fmt.Sprintf("paused tube %s for %s", name, d)
+	})
+}
+
+func (s *server) Peek(ctx context.Context, state, name string) (uint64, []byte, error) {
+	if !s.connected.Load() {
+		return 0, nil, errors.New("can't peek, not connected to a beanstalk server")
 	}
 
 	var (
 		id   uint64
 		body []byte
-		err  error
 	)
-	switch state {
-	case "buried":
-		id, body, err = tube.PeekBuried()
-	case "delayed":
-		id, body, err = tube.PeekDelayed()
-	case "ready":
-		id, body, err = tube.PeekReady()
-	}
+	err := s.do(ctx, func() (err error) {
+		tube := s.tube(name)
+		switch state {
+		case "buried":
+			id, body, err = tube.PeekBuried()
+		case "delayed":
+			id, body, err = tube.PeekDelayed()
+		case "ready":
+			id, body, err = tube.PeekReady()
+		}
+		return
+	})
 
 	return id, body, err
 }
 
-func (s *server) PeekJob(id uint64) ([]byte, error) {
-	if !s.connected {
+func (s *server) PeekJob(ctx context.Context, id uint64) ([]byte, error) {
+	if !s.connected.Load() {
 		return nil, errors.New("can't peek, not connected to a beanstalk server")
 	}
 
-	if body, err := s.bs.Peek(id); err != nil {
+	var body []byte
+	if err := s.do(ctx, func() (err error) {
+		body, err = s.bs.Peek(id)
+		return
+	}); err != nil {
 		return nil, fmt.Errorf("failed to peek job: %w", err)
-	} else {
-		return body, nil
 	}
+
+	return body, nil
 }
 
-func (s *server) Put(body []byte, name string) (uint64, error) {
-	tube := beanstalk.Tube{
-		Conn: s.bs,
-		Name: name,
+func (s *server) Put(ctx context.Context, body []byte, name string) (uint64, error) {
+	return s.PutJob(ctx, body, name, 1, 0, 180*time.Second)
+}
+
+// PutJob puts a job on the tube with the given priority, delay and time to run.
+func (s *server) PutJob(ctx context.Context, body []byte, name string, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	var id uint64
+	err := s.change(ctx, func() (err error) {
+		id, err = s.tube(name).Put(body, pri, delay, ttr)
+		return
+	}, func() string {
+		return fmt.Sprintf("put job #%d on tube %s", id, name)
+	})
+	return id, err
+}
+
+func (s *server) Release(ctx context.Context, id uint64, pri uint32, delay time.Duration) error {
+	return s.change(ctx, func() error {
+		return s.bs.Release(id, pri, delay)
+	}, func() string {
+		return fmt.Sprintf("released job #%d with a %s delay", id, delay)
+	})
+}
+
+// Reserve reserves a job from any of the tubes, waiting up to timeout for one
+// to become ready. The tubes become the connection's watch list.
+func (s *server) Reserve(ctx context.Context, timeout time.Duration, tubes ...string) (uint64, []byte, error) {
+	if !s.connected.Load() {
+		return 0, nil, errors.New("can't reserve, not connected to a beanstalk server")
 	}
-	return tube.Put(body, 1, 0, 180*time.Second)
+
+	var (
+		id   uint64
+		body []byte
+	)
+	err := s.do(ctx, func() (err error) {
+		s.bs.TubeSet = *beanstalk.NewTubeSet(s.bs, tubes...)
+		id, body, err = s.bs.TubeSet.Reserve(timeout)
+		return
+	})
+	return id, body, err
 }
 
-func (s *server) Stats() (map[string]string, error) {
-	if !s.connected {
+func (s *server) Stats(ctx context.Context) (map[string]string, error) {
+	if !s.connected.Load() {
 		return nil, errors.New("can't provide stats, not connected to a beanstalk server")
 	}
 
-	return s.bs.Stats()
+	var stats map[string]string
+	err := s.do(ctx, func() (err error) {
+		stats, err = s.bs.Stats()
+		return
+	})
+	return stats, err
 }
 
-func (s *server) StatsJob(id uint64) (map[string]string, error) {
-	if !s.connected {
+func (s *server) StatsJob(ctx context.Context, id uint64) (map[string]string, error) {
+	if !s.connected.Load() {
 		return nil, errors.New("can't stats job, not connected to a beanstalk server")
 	}
 
-	return s.bs.StatsJob(id)
+	var stats map[string]string
+	err := s.do(ctx, func() (err error) {
+		stats, err = s.bs.StatsJob(id)
+		return
+	})
+	return stats, err
 }
 
-func (s *server) StatsTube(name string) (map[string]string, error) {
-	if !s.connected {
+func (s *server) StatsTube(ctx context.Context, name string) (map[string]string, error) {
+	if !s.connected.Load() {
 		return nil, errors.New("can't stats tubes, not connected to a beanstalk server")
 	}
 
-	tube := beanstalk.Tube{
-		Conn: s.bs,
-		Name: name,
-	}
-	return tube.Stats()
+	var stats map[string]string
+	err := s.do(ctx, func() (err error) {
+		stats, err = s.tube(name).Stats()
+		return
+	})
+	return stats, err
+}
+
+// Touch gives the reserved job more time to run.
+func (s *server) Touch(ctx context.Context, id uint64) error {
+	return s.do(ctx, func() error {
+		return s.bs.Touch(id)
+	})
 }
 
 func (s *server) UseTube(name string) {
-	newTube := beanstalk.Tube{
-		Conn: s.bs,
-		Name: name,
-	}
-	s.bs.Tube = newTube
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bs.Tube = *s.tube(name)
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// parseTarget parses the server to connect to. This may be given as:
+//
+//	host, host:port or [ipv6]:port
+//	unix:///path/to/socket
+//	beanstalk://host:port/tube, which also selects the tube to use
+//	@profile, for the server configured in the named profile
+func (c *config) parseTarget(target string) ([]serverOption, error) {
+	if name, ok := strings.CutPrefix(target, "@"); ok {
+		p, err := c.profile(name)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(p.Connect, "@") {
+			return nil, fmt.Errorf("profile '%s' can't connect to another profile", name)
+		}
+
+		opts, err := c.parseTarget(p.Connect)
+		if err != nil {
+			return nil, err
+		}
+		if !p.transport.isZero() {
+			opts = append(opts, WithTransport(p.transport))
+		}
+		if p.ReadOnly {
+			opts = append(opts, WithReadOnly(true))
+		}
+		return append(opts, WithProfile(name)), nil
+	}
+
+	if path, ok := strings.CutPrefix(target, "unix:"); ok {
+		path = strings.TrimPrefix(path, "//")
+		if path == "" {
+			return nil, errors.New("no socket path given")
+		}
+		return []serverOption{WithSocket(path)}, nil
+	}
+
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "beanstalk" {
+			return nil, fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+		}
+
+		opts, err := parseHostPort(u.Hostname(), u.Port())
+		if err != nil {
+			return nil, err
+		}
+		if tube := strings.Trim(u.Path, "/"); tube != "" {
+			opts = append(opts, WithTube(tube))
+		}
+		return opts, nil
+	}
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		// Either no port was given, or it's a bare IPv6 address
+		host = strings.TrimSuffix(strings.TrimPrefix(target, "["), "]")
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("unable to parse address '%s'", target)
+		}
+		port = ""
+	}
+
+	return parseHostPort(host, port)
+}
+
+func parseHostPort(host, portStr string) ([]serverOption, error) {
+	opts := []serverOption{WithHost(host)}
+
+	if portStr != "" {
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse port '%s': %w", portStr, err)
+		}
+
+		opts = append(opts, WithPort(int(port)))
+	}
+
+	return opts, nil
+}
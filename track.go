@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// trackCounters are the job stats counting what's happened to a job, with
+// the events they record.
+var trackCounters = []struct{ stat, event string }{
+	{"reserves", "reserved"},
+	{"timeouts", "timed out"},
+	{"releases", "released"},
+	{"buries", "buried"},
+	{"kicks", "kicked"},
+}
+
+// trackEvent is something which happened to a tracked job, as seen between
+// polls of its stats.
+type trackEvent struct {
+	Job    uint64    `json:"job"`
+	At     time.Time `json:"at"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+func (e trackEvent) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s", e.Event, e.Detail))
+}
+
+// tracker records the events in jobs' lifecycles from their stats.
+type tracker struct {
+	last   map[uint64]map[string]string
+	events []trackEvent
+}
+
+func newTracker() *tracker {
+	return &tracker{last: map[uint64]map[string]string{}}
+}
+
+// update records the events between the job's last stats and these, and
+// returns them.
+func (t *tracker) update(id uint64, stats map[string]string, at time.Time) []trackEvent {
+	last, seen := t.last[id]
+	t.last[id] = stats
+
+	if !seen {
+		return t.record(trackEvent{Job: id, At: at, Event: "seen", Detail: fmt.Sprintf("%s on %s", stats["state"], stats["tube"])})
+	}
+
+	var events []trackEvent
+	for _, counter := range trackCounters {
+		before, _ := strconv.Atoi(last[counter.stat])
+		after, _ := strconv.Atoi(stats[counter.stat])
+		if after > before {
+			e := trackEvent{Job: id, At: at, Event: counter.event}
+			if after-before > 1 {
+				e.Detail = fmt.Sprintf("x%d", after-before)
+			}
+			events = append(events, e)
+		}
+	}
+	if last["pri"] != stats["pri"] {
+		events = append(events, trackEvent{Job: id, At: at, Event: "priority", Detail: fmt.Sprintf("%s → %s", last["pri"], stats["pri"])})
+	}
+	if last["state"] != stats["state"] {
+		events = append(events, trackEvent{Job: id, At: at, Event: "state", Detail: fmt.Sprintf("%s → %s", last["state"], stats["state"])})
+	}
+	return t.record(events...)
+}
+
+// deleted records the job being deleted.
+func (t *tracker) deleted(id uint64, at time.Time) trackEvent {
+	delete(t.last, id)
+	return t.record(trackEvent{Job: id, At: at, Event: "deleted"})[0]
+}
+
+func (t *tracker) seen(id uint64) bool {
+	_, ok := t.last[id]
+	return ok
+}
+
+func (t *tracker) record(events ...trackEvent) []trackEvent {
+	t.events = append(t.events, events...)
+	return events
+}
+
+// timeline renders each job's events, timed from when it was first seen.
+func (t *tracker) timeline(ids []uint64) string {
+	var sb strings.Builder
+	cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+
+	for _, id := range ids {
+		var first time.Time
+		for _, e := range t.events {
+			if e.Job != id {
+				continue
+			}
+			if first.IsZero() {
+				first = e.At
+				sb.WriteString(cyan(fmt.Sprintf("Job #%d", id)) + "\n")
+			}
+			sb.WriteString(fmt.Sprintf("  %s  %-8s %s\n", e.At.Format("15:04:05.000"), "+"+e.At.Sub(first).Round(time.Millisecond).String(), e))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+)
+
+// tubeColumn is a column list-tubes can show, from a tube's stats.
+type tubeColumn struct {
+	stat   string
+	colour func(format string, a ...interface{}) string
+
+	// format formats the stat, if it isn't shown as it is
+	format func(stats map[string]string) string
+}
+
+var tubeColumns = map[string]tubeColumn{
+	"ready":    {stat: "current-jobs-ready", colour: color.GreenString},
+	"reserved": {stat: "current-jobs-reserved", colour: color.BlueString},
+	"urgent":   {stat: "current-jobs-urgent", colour: color.GreenString},
+	"delayed":  {stat: "current-jobs-delayed", colour: color.YellowString},
+	"buried":   {stat: "current-jobs-buried", colour: color.RedString},
+	"watching": {stat: "current-watching", colour: fmt.Sprintf},
+	"waiting":  {stat: "current-waiting", colour: fmt.Sprintf},
+	"using":    {stat: "current-using", colour: fmt.Sprintf},
+	"paused":   {stat: "pause-time-left", colour: color.MagentaString, format: pauseLeft},
+	"total":    {stat: "total-jobs", colour: fmt.Sprintf},
+}
+
+// listTubesOptions control what list-tubes shows. Defaults can be set in the
+// config, for every server or per profile. Desc and NonEmpty are nil unless
+// set, so a profile can turn off what's set for every server.
+type listTubesOptions struct {
+	Columns  []string `yaml:"columns"`
+	Sort     string   `yaml:"sort"`
+	Desc     *bool    `yaml:"desc"`
+	Filter   string   `yaml:"filter"`
+	NonEmpty *bool    `yaml:"non_empty"`
+	Top      int      `yaml:"top"`
+}
+
+var defaultListTubesOptions = listTubesOptions{
+	Columns: []string{"ready", "delayed", "buried", "paused"},
+	Sort:    "name",
+}
+
+// listTubesOptions returns the options for list-tubes on the server, from the
+// config and then args.
+func (c *cli) listTubesOptions(args []string) (listTubesOptions, error) {
+	opts := defaultListTubesOptions
+	opts.merge(c.config.ListTubes)
+	if p, err := c.config.profile(c.server.profile); err == nil {
+		opts.merge(p.ListTubes)
+	}
+
+	var output bytes.Buffer
+	flags := flag.NewFlagSet("list-tubes", flag.ContinueOnError)
+	flags.SetOutput(&output)
+	columns := flags.String("columns", strings.Join(opts.Columns, ","), "Columns to show, from "+strings.Join(sortedMapKeys(tubeColumns), ","))
+	flags.StringVar(&opts.Sort, "sort", opts.Sort, "Column to sort by, or name")
+	desc := flags.Bool("desc", opts.Desc != nil && *opts.Desc, "Sort in descending order")
+	flags.StringVar(&opts.Filter, "filter", opts.Filter, "Only show tubes matching a glob")
+	nonEmpty := flags.Bool("non-empty", opts.NonEmpty != nil && *opts.NonEmpty, "Only show tubes with jobs")
+	flags.IntVar(&opts.Top, "top", opts.Top, "Only show this many tubes, 0 for all")
+
+	if err := flags.Parse(args); err != nil {
+		return opts, errors.New(strings.TrimSpace(output.String()))
+	}
+	if flags.NArg() > 0 {
+		return opts, errors.New("too many arguments provided")
+	}
+	opts.Desc, opts.NonEmpty = desc, nonEmpty
+
+	opts.Columns = nil
+	for _, column := range strings.Split(*columns, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			opts.Columns = append(opts.Columns, column)
+		}
+	}
+
+	return opts, opts.validate()
+}
+
+// merge overrides the options with those set in o.
+func (opts *listTubesOptions) merge(o listTubesOptions) {
+	if len(o.Columns) > 0 {
+		opts.Columns = o.Columns
+	}
+	if o.Sort != "" {
+		opts.Sort = o.Sort
+	}
+	if o.Filter != "" {
+		opts.Filter = o.Filter
+	}
+	if o.Top != 0 {
+		opts.Top = o.Top
+	}
+	if o.Desc != nil {
+		opts.Desc = o.Desc
+	}
+	if o.NonEmpty != nil {
+		opts.NonEmpty = o.NonEmpty
+	}
+}
+
+func (opts listTubesOptions) validate() error {
+	for _, column := range opts.Columns {
+		if _, ok := tubeColumns[column]; !ok {
+			return fmt.Errorf("unknown column '%s'", column)
+		}
+	}
+	if _, ok := tubeColumns[opts.Sort]; !ok && opts.Sort != "name" {
+		return fmt.Errorf("can't sort by unknown column '%s'", opts.Sort)
+	}
+	if _, err := path.Match(opts.Filter, ""); err != nil {
+		return fmt.Errorf("invalid filter: %w", err)
+	}
+	if opts.Top < 0 {
+		return errors.New("top can't be negative")
+	}
+	return nil
+}
+
+// renderTubes renders the tubes' stats as a table, with a row of totals.
+func renderTubes(tubes map[string]map[string]string, opts listTubesOptions) string {
+	desc := opts.Desc != nil && *opts.Desc
+	nonEmpty := opts.NonEmpty != nil && *opts.NonEmpty
+
+	var names []string
+	for _, tube := range sortedMapKeys(tubes) {
+		if ok, _ := path.Match(opts.Filter, tube); opts.Filter != "" && !ok {
+			continue
+		}
+		if nonEmpty && tubeJobs(tubes[tube]) == 0 {
+			continue
+		}
+		names = append(names, tube)
+	}
+
+	sort.SliceStable(names, func(a, b int) bool {
+		if opts.Sort == "name" {
+			return names[a] < names[b] != desc
+		}
+
+		stat := tubeColumns[opts.Sort].stat
+		x, _ := strconv.Atoi(tubes[names[a]][stat])
+		y, _ := strconv.Atoi(tubes[names[b]][stat])
+		if desc {
+			return x > y
+		}
+		return x < y
+	})
+
+	var output bytes.Buffer
+	table := tablewriter.NewWriter(&output)
+	table.SetBorder(false)
+	cyan := color.New(color.FgCyan, color.Bold).SprintFunc()
+
+	table.SetHeader(append([]string{"Tube"}, opts.Columns...))
+
+	totals := make([]int, len(opts.Columns))
+	for n, tube := range names {
+		stats := tubes[tube]
+		for c, column := range opts.Columns {
+			if column == "paused" {
+				if pauseLeft(stats) != "" {
+					totals[c]++
+				}
+				continue
+			}
+			v, _ := strconv.Atoi(stats[tubeColumns[column].stat])
+			totals[c] += v
+		}
+
+		if opts.Top > 0 && n >= opts.Top {
+			continue
+		}
+
+		row := []string{cyan(tube)}
+		for _, column := range opts.Columns {
+			col := tubeColumns[column]
+			value := stats[col.stat]
+			if col.format != nil {
+				value = col.format(stats)
+			}
+			row = append(row, col.colour("%s", value))
+		}
+		table.Append(row)
+	}
+
+	footer := []string{fmt.Sprintf("Total (%d tubes)", len(names))}
+	for c, column := range opts.Columns {
+		if column == "paused" {
+			footer = append(footer, fmt.Sprintf("%d paused", totals[c]))
+		} else {
+			footer = append(footer, strconv.Itoa(totals[c]))
+		}
+	}
+	table.SetFooter(footer)
+
+	table.Render()
+	return output.String()
+}
+
+// tubeJobs is the number of jobs on a tube, in any state.
+func tubeJobs(stats map[string]string) int {
+	var jobs int
+	for _, stat := range []string{"current-jobs-ready", "current-jobs-reserved", "current-jobs-delayed", "current-jobs-buried"} {
+		n, _ := strconv.Atoi(stats[stat])
+		jobs += n
+	}
+	return jobs
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+const (
+	maxJobSize = 1 << 20
+)
+
+type webServer struct {
+	server *server
+	config *config
+	static http.Handler
+}
+
+func runWeb(e env, args []string) error {
+	flags := flag.NewFlagSet("web", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8080", "Address to serve the dashboard on")
+	flags.Parse(args)
+
+	s := e.newServer(e.target...)
+	if err := s.connect(context.Background()); err != nil {
+		return err
+	}
+
+	static, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("serving dashboard on %s", *listen)
+	return http.ListenAndServe(*listen, &webServer{
+		server: s,
+		config: e.config,
+		static: http.FileServer(http.FS(static)),
+	})
+}
+
+func (ws *webServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var path []string
+	for _, part := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		path = append(path, unescaped)
+	}
+
+	if r.Method != http.MethodGet && !sameOrigin(r) {
+		writeError(w, http.StatusForbidden, errors.New("cross-origin requests can't change jobs"))
+		return
+	}
+
+	ctx, cancel := ws.server.withTimeout(withActor(r.Context(), "web "+r.RemoteAddr))
+	defer cancel()
+
+	route := r.Method + " " + strings.Join(routePattern(path), "/")
+	switch route {
+	case "GET info":
+		ws.info(w)
+	case "GET tubes":
+		ws.listTubes(ctx, w)
+	case "GET tubes/*/stats":
+		ws.statsTube(ctx, w, path[1])
+	case "POST tubes/*/jobs":
+		ws.put(ctx, w, r, path[1])
+	case "POST tubes/*/kick":
+		ws.kick(ctx, w, r, path[1])
+	case "GET jobs/*":
+		ws.job(ctx, w, path[1])
+	case "DELETE jobs/*":
+		ws.delete(ctx, w, path[1])
+	default:
+		if r.Method == http.MethodGet {
+			ws.static.ServeHTTP(w, r)
+		} else {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+	}
+}
+
+// sameOrigin reports whether the request came from the dashboard, rather
+// than another site's page in the same browser. Browsers send an Origin with
+// requests which aren't GETs, other clients needn't.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// routePattern replaces the tube names and job ids in path with wildcards.
+func routePattern(path []string) []string {
+	pattern := append([]string{}, path...)
+	if len(pattern) > 1 && (pattern[0] == "tubes" || pattern[0] == "jobs") {
+		pattern[1] = "*"
+	}
+	return pattern
+}
+
+func (ws *webServer) info(w http.ResponseWriter) {
+	connection, _ := ws.server.ConnectionStr()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"connection": connection,
+		"read_only":  ws.server.readOnly,
+		"version":    Version,
+	})
+}
+
+func (ws *webServer) listTubes(ctx context.Context, w http.ResponseWriter) {
+	tubes, tubeErrs, err := ws.server.GetTubeStats(ctx)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	type tube struct {
+		Name  string                 `json:"name"`
+		Stats map[string]interface{} `json:"stats,omitempty"`
+		Error string                 `json:"error,omitempty"`
+	}
+
+	list := []tube{}
+	for _, name := range sortedMapKeys(tubes) {
+		list = append(list, tube{Name: name, Stats: statsJSON(tubes[name])})
+	}
+	for _, name := range sortedMapKeys(tubeErrs) {
+		if !isNotFound(tubeErrs[name]) {
+			list = append(list, tube{Name: name, Error: tubeErrs[name].Error()})
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (ws *webServer) statsTube(ctx context.Context, w http.ResponseWriter, name string) {
+	stats, err := ws.server.StatsTube(ctx, name)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statsJSON(stats))
+}
+
+func (ws *webServer) put(ctx context.Context, w http.ResponseWriter, r *http.Request, tube string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxJobSize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if len(body) > maxJobSize {
+		writeError(w, http.StatusRequestEntityTooLarge, errors.New("job too big"))
+		return
+	} else if len(body) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no data in job, not adding to tube"))
+		return
+	}
+
+	id, err := ws.server.Put(ctx, body, tube)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]uint64{"id": id})
+}
+
+func (ws *webServer) kick(ctx context.Context, w http.ResponseWriter, r *http.Request, tube string) {
+	toKickStr := r.URL.Query().Get("bound")
+	if toKickStr == "" {
+		stats, err := ws.server.StatsTube(ctx, tube)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		toKickStr = stats["current-jobs-buried"]
+	}
+
+	toKick, err := strconv.Atoi(toKickStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	kicked, err := ws.server.Kick(ctx, tube, toKick)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"kicked": kicked})
+}
+
+func (ws *webServer) job(ctx context.Context, w http.ResponseWriter, idStr string) {
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unable to parse job: %w", err))
+		return
+	}
+
+	body, err := ws.server.PeekJob(ctx, id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	stats, err := ws.server.StatsJob(ctx, id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	r, err := ws.config.redactionFor(stats["tube"])
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if r == nil {
+		writeJSON(w, http.StatusOK, jobJSON(id, body, stats))
+		return
+	}
+
+	if body, err = ws.config.redactBody(r, stats["tube"], body); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	job := jobJSON(id, body, stats)
+	job["redacted"] = true
+	writeJSON(w, http.StatusOK, job)
+}
+
+// jobJSON describes a job for encoding as JSON. Bodies which aren't valid
+// UTF-8 are base64 encoded.
+func jobJSON(id uint64, body []byte, stats map[string]string) map[string]interface{} {
+	job := map[string]interface{}{
+		"id":    id,
+		"stats": statsJSON(stats),
+	}
+	if utf8.Valid(body) {
+		job["body"] = string(body)
+	} else {
+		job["body_base64"] = body
+	}
+	return job
+}
+
+func (ws *webServer) delete(ctx context.Context, w http.ResponseWriter, idStr string) {
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unable to parse job: %w", err))
+		return
+	}
+
+	if err := ws.server.Delete(ctx, id); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statsJSON converts numeric stats to numbers.
+func statsJSON(stats map[string]string) map[string]interface{} {
+	converted := map[string]interface{}{}
+	for key, value := range stats {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			converted[key] = n
+		} else if f, err := strconv.ParseFloat(value, 64); err == nil {
+			converted[key] = f
+		} else {
+			converted[key] = value
+		}
+	}
+	return converted
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeServerError picks the status for an error from the beanstalk server.
+func writeServerError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errReadOnly):
+		writeError(w, http.StatusForbidden, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, err)
+	case isNotFound(err):
+		writeError(w, http.StatusNotFound, err)
+	default:
+		writeError(w, http.StatusBadGateway, err)
+	}
+}